@@ -2,6 +2,8 @@ package replvar
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"html"
 	"net/url"
 	"strings"
@@ -17,7 +19,8 @@ type FilterFunc func(ctx context.Context, input any, args []any) (any, error)
 var filters = map[string]FilterFunc{}
 
 // RegisterFilter registers a named filter function that can be used with
-// the pipe syntax (e.g. {{var|name}}).
+// the pipe syntax (e.g. {{var|name}}). Filters are looked up when parsing,
+// so they must be registered before any expression using them is parsed.
 func RegisterFilter(name string, fn FilterFunc) {
 	filters[name] = fn
 }
@@ -27,12 +30,57 @@ func LookupFilter(name string) FilterFunc {
 	return filters[name]
 }
 
+// FunctionFunc is a function that can be called from expressions. It
+// receives the resolved arguments and returns the result.
+type FunctionFunc func(ctx context.Context, args []any) (any, error)
+
+// function is a registered FunctionFunc along with its properties.
+type function struct {
+	fn   FunctionFunc
+	pure bool // result only depends on args
+}
+
+var functions = map[string]*function{}
+
+// RegisterFunction registers a named function that can be called from
+// expressions (e.g. {{name(a, b)}}). Calls to functions registered this way
+// are never considered static.
+func RegisterFunction(name string, fn FunctionFunc) {
+	functions[name] = &function{fn: fn}
+}
+
+// RegisterPureFunction registers a named function whose result only depends
+// on its arguments. Calls to such functions are considered static when all
+// their arguments are static, allowing them to be folded.
+func RegisterPureFunction(name string, fn FunctionFunc) {
+	functions[name] = &function{fn: fn, pure: true}
+}
+
+// LookupFunction returns the FunctionFunc for the given name, or nil if not found.
+func LookupFunction(name string) FunctionFunc {
+	if f := functions[name]; f != nil {
+		return f.fn
+	}
+	return nil
+}
+
+// lookupFunction returns the registered function for the given name, or nil.
+func lookupFunction(name string) *function {
+	return functions[name]
+}
+
 func init() {
 	RegisterFilter("json", filterJSON)
 	RegisterFilter("html", filterHTML)
 	RegisterFilter("url", filterURL)
 	RegisterFilter("upper", filterUpper)
 	RegisterFilter("lower", filterLower)
+	RegisterFilter("truncate", filterTruncate)
+
+	RegisterPureFunction("min", funcMin)
+	RegisterPureFunction("max", funcMax)
+	RegisterPureFunction("concat", funcConcat)
+	RegisterPureFunction("range", funcRange)
 }
 
 func filterJSON(ctx context.Context, input any, args []any) (any, error) {
@@ -44,21 +92,136 @@ func filterJSON(ctx context.Context, input any, args []any) (any, error) {
 }
 
 func filterHTML(_ context.Context, input any, _ []any) (any, error) {
-	s, _ := typutil.AsString(input)
+	s := asString(input)
 	return html.EscapeString(s), nil
 }
 
 func filterURL(_ context.Context, input any, _ []any) (any, error) {
-	s, _ := typutil.AsString(input)
+	s := asString(input)
 	return url.QueryEscape(s), nil
 }
 
 func filterUpper(_ context.Context, input any, _ []any) (any, error) {
-	s, _ := typutil.AsString(input)
+	s := asString(input)
 	return strings.ToUpper(s), nil
 }
 
 func filterLower(_ context.Context, input any, _ []any) (any, error) {
-	s, _ := typutil.AsString(input)
+	s := asString(input)
 	return strings.ToLower(s), nil
 }
+
+// filterTruncate shortens the input to at most args[0] characters.
+func filterTruncate(_ context.Context, input any, args []any) (any, error) {
+	if len(args) != 1 {
+		return nil, errors.New("truncate requires one argument")
+	}
+	num, ok := typutil.AsNumber(args[0])
+	if !ok {
+		return nil, fmt.Errorf("truncate requires a numeric argument, got %T", args[0])
+	}
+	var n int
+	switch v := num.(type) {
+	case int64:
+		n = int(v)
+	case uint64:
+		n = int(v)
+	case float64:
+		n = int(v)
+	}
+	s := asString(input)
+	r := []rune(s)
+	if n < 0 || len(r) <= n {
+		return s, nil
+	}
+	return string(r[:n]), nil
+}
+
+func funcMin(_ context.Context, args []any) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("min requires at least one argument")
+	}
+	res := args[0]
+	for _, v := range args[1:] {
+		if compareValues(v, res) < 0 {
+			res = v
+		}
+	}
+	return res, nil
+}
+
+func funcMax(_ context.Context, args []any) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("max requires at least one argument")
+	}
+	res := args[0]
+	for _, v := range args[1:] {
+		if compareValues(v, res) > 0 {
+			res = v
+		}
+	}
+	return res, nil
+}
+
+func funcConcat(_ context.Context, args []any) (any, error) {
+	var b strings.Builder
+	for _, v := range args {
+		b.WriteString(asString(v))
+	}
+	return b.String(), nil
+}
+
+// maxRangeLength is the maximum number of values returned by range.
+const maxRangeLength = 100000
+
+// funcRange returns the integers from start (0 by default) up to but not
+// including end, separated by step (1 by default), as in range(end),
+// range(start, end) or range(start, end, step).
+func funcRange(_ context.Context, args []any) (any, error) {
+	if len(args) == 0 || len(args) > 3 {
+		return nil, errors.New("range requires one to three arguments")
+	}
+	nums := make([]int64, len(args))
+	for i, arg := range args {
+		num, ok := typutil.AsNumber(arg)
+		if !ok {
+			return nil, fmt.Errorf("range requires numeric arguments, got %T", arg)
+		}
+		switch v := num.(type) {
+		case int64:
+			nums[i] = v
+		case uint64:
+			nums[i] = int64(v)
+		case float64:
+			nums[i] = int64(v)
+		}
+	}
+	start, end, step := int64(0), nums[0], int64(1)
+	if len(nums) > 1 {
+		start, end = nums[0], nums[1]
+	}
+	if len(nums) > 2 {
+		step = nums[2]
+	}
+	if step == 0 {
+		return nil, errors.New("range step must not be zero")
+	}
+
+	// compute the number of values without overflowing
+	var n uint64
+	switch {
+	case step > 0 && end > start:
+		n = (uint64(end)-uint64(start)-1)/uint64(step) + 1
+	case step < 0 && end < start:
+		n = (uint64(start)-uint64(end)-1)/uint64(-step) + 1
+	}
+	if n > maxRangeLength {
+		return nil, fmt.Errorf("range cannot produce more than %d values", maxRangeLength)
+	}
+
+	res := make([]any, n)
+	for i := range res {
+		res[i] = start + int64(i)*step
+	}
+	return res, nil
+}
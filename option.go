@@ -0,0 +1,28 @@
+package replvar
+
+// ParseOption configures how templates and expressions are parsed. Options
+// are passed to ParseString, ParseVariable or Replace.
+type ParseOption func(*parser)
+
+// WithDelimiters sets the delimiters marking variable expressions within a
+// template, instead of the default {{ and }}. This is useful for templates
+// containing other template syntaxes that must be passed through untouched.
+//
+// For example, WithDelimiters("${", "}") parses "Hello ${name}!". Delimiters
+// must not be empty.
+func WithDelimiters(open, close string) ParseOption {
+	return func(p *parser) {
+		p.open = []rune(open)
+		p.close = []rune(close)
+	}
+}
+
+// WithValueLogic makes the logical operators && and || return the operand
+// that decided the result instead of a bool, as in JavaScript. For example
+// {{title || 'Untitled'}} returns title if it is truthy, and 'Untitled'
+// otherwise, while {{user && user.name}} returns user.name if user is truthy.
+func WithValueLogic() ParseOption {
+	return func(p *parser) {
+		p.valueLogic = true
+	}
+}
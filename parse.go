@@ -1,102 +1,269 @@
 package replvar
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"strconv"
+	"strings"
 	"unicode"
-
-	"github.com/KarpelesLab/typutil"
+	"unicode/utf8"
 )
 
 // parser holds the state for parsing variable expressions and strings.
 // It operates on a buffer of runes and provides methods for tokenization
 // and AST construction.
 type parser struct {
-	buf []rune // input buffer of runes to be parsed
+	src   []rune // full input, buf is a suffix of it
+	buf   []rune // input buffer of runes to be parsed
+	open  []rune // delimiter starting a variable, {{ by default
+	close []rune // delimiter ending a variable, }} by default
+	depth int    // number of open groups, close does not end a variable while > 0
+	trim  bool   // set when a tag ends with -}}, whitespace following it must be skipped
+
+	valueLogic bool // && and || return the deciding operand instead of a bool
 }
 
 // escapedChars maps escape sequence characters to their actual values.
 // These are recognized within double-quoted strings (e.g., "\n" becomes newline).
 var escapedChars = map[rune]rune{
+	'a':  '\a',
+	'b':  '\b',
+	'f':  '\f',
 	'r':  '\r',
 	'n':  '\n',
 	't':  '\t',
 	'v':  '\v',
 	'\\': '\\',
+	'\'': '\'',
+	'"':  '"',
+}
+
+// keywords maps reserved names to the literal value they represent.
+var keywords = map[string]Var{
+	"true":  &staticVar{true},
+	"false": &staticVar{false},
+	"null":  varNull{},
+	"nil":   varNull{},
 }
 
 // ParseString parses a string that may contain embedded variable expressions.
-// Variable expressions are delimited by {{ and }}. The mode parameter controls
-// how nested variables are handled:
+// Variable expressions are delimited by {{ and }} unless WithDelimiters is
+// used. The mode parameter controls how nested variables are handled:
 //   - "text": variables are resolved to their string representation
 //   - "json": variables are automatically JSON-encoded when embedded
-func ParseString(s string, mode string) (Var, error) {
-	p := newParser(s)
+func ParseString(s string, mode string, opts ...ParseOption) (Var, error) {
+	p, err := newParser(s, opts)
+	if err != nil {
+		return nil, err
+	}
 	return p.parseString(-1, mode)
 }
 
 // ParseVariable parses a variable expression (the content typically found inside {{}}).
 // This handles variable names, operators, and nested expressions directly.
-func ParseVariable(s string) (Var, error) {
-	p := newParser(s)
+func ParseVariable(s string, opts ...ParseOption) (Var, error) {
+	p, err := newParser(s, opts)
+	if err != nil {
+		return nil, err
+	}
 	return p.parse(false)
 }
 
-// newParser creates a new parser initialized with the given string.
-func newParser(s string) *parser {
+// newParser creates a new parser initialized with the given string and options.
+func newParser(s string, opts []ParseOption) (*parser, error) {
 	p := &parser{
-		buf: []rune(s),
+		src:   []rune(s),
+		open:  []rune("{{"),
+		close: []rune("}}"),
+	}
+	p.buf = p.src
+	for _, opt := range opts {
+		opt(p)
+	}
+	if len(p.open) == 0 || len(p.close) == 0 {
+		return nil, errors.New("delimiters must not be empty")
+	}
+	return p, nil
+}
+
+// parse parses a variable expression.
+//
+// If varStart is true, parsing expects to end with the closing delimiter
+// (TokenVariableEnd). If varStart is false, the closing delimiter will raise
+// an error.
+func (p *parser) parse(varStart bool) (Var, error) {
+	var v Var
+	var err error
+	if varStart {
+		// a variable within a string within a group starts anew
+		depth := p.depth
+		p.depth = 0
+		defer func() { p.depth = depth }()
+		v, _, err = p.parseExpr(TokenVariableEnd)
+	} else {
+		v, _, err = p.parseExpr()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return varNull{}, nil
 	}
-	return p
+	return v, nil
 }
 
-// parse parses a variable expression using a two-stage approach:
+// parseExpr parses an expression using a two-stage approach:
 //
 // Stage 1: Tokenization - reads tokens and converts them to Var objects.
-// Operators are stored as varPendingToken placeholders.
+// Operators are stored as varPendingToken placeholders, parenthesized
+// groups are parsed recursively into a single Var, and member/index access
+// as well as filter pipes are applied directly to the preceding operand.
 //
 // Stage 2: Operator association - processes pending tokens to build the
 // final AST by associating operators with their operands.
 //
-// If varStart is true, parsing expects to end with }} (TokenVariableEnd).
-// If varStart is false, }} will raise an error.
-func (p *parser) parse(varStart bool) (Var, error) {
+// Parsing stops when one of the ends tokens is found, and that token is
+// returned. If no ends are given, parsing continues until the end of the
+// buffer. An empty expression returns a nil Var.
+func (p *parser) parseExpr(ends ...Token) (Var, Token, error) {
 	var res []Var
+	var endTok Token
 
 	// Stage 1: Tokenization loop
 mainloop:
 	for {
+		p.skipSpaces()
 		if p.empty() {
-			if varStart {
+			if len(ends) > 0 {
 				// unexpected
-				return nil, io.ErrUnexpectedEOF
+				if ends[0] == TokenVariableEnd {
+					return nil, TokenInvalid, io.ErrUnexpectedEOF
+				}
+				return nil, TokenInvalid, fmt.Errorf("missing %s: %w", ends[0], io.ErrUnexpectedEOF)
 			}
 			// reached end of buffer
 			break
 		}
 		tok, dat := p.readToken()
+		for _, end := range ends {
+			if tok == end {
+				endTok = tok
+				break mainloop
+			}
+		}
 		switch tok {
-		case TokenVariableEnd:
-			if !varStart {
-				return nil, fmt.Errorf("unexpected token }}")
+		case TokenVariableEnd, TokenParenClose, TokenBracketClose, TokenBraceClose:
+			if c := closingToken(ends); c != TokenInvalid {
+				// a group was not closed before the end of the expression
+				// or before a different closing token
+				return nil, TokenInvalid, fmt.Errorf("invalid syntax: missing %s before %s", c, tok)
+			}
+			return nil, TokenInvalid, fmt.Errorf("unexpected token %s", tok)
+		case TokenComma:
+			return nil, TokenInvalid, fmt.Errorf("unexpected token %s", tok)
+		case TokenBraceOpen:
+			if endsWithOperand(res) {
+				return nil, TokenInvalid, fmt.Errorf("unexpected token %s", tok)
+			}
+			sub, err := p.parseObject()
+			if err != nil {
+				return nil, TokenInvalid, err
+			}
+			res = append(res, sub)
+		case TokenDot, TokenOptionalDot:
+			// member access applies to the operand immediately before it
+			if !endsWithOperand(res) {
+				return nil, TokenInvalid, fmt.Errorf("invalid syntax: %s not preceded by var", tok)
+			}
+			sub, err := p.parseAccess(res[len(res)-1], tok == TokenOptionalDot)
+			if err != nil {
+				return nil, TokenInvalid, err
+			}
+			res[len(res)-1] = sub
+		case TokenOr:
+			// a | followed by a name is a filter pipe
+			if endsWithOperand(res) {
+				sub, err := p.parseFilter(res[len(res)-1])
+				if err != nil {
+					return nil, TokenInvalid, err
+				}
+				if sub != nil {
+					res[len(res)-1] = sub
+					break
+				}
+			}
+			res = append(res, varPendingToken(tok))
+		case TokenNotMatch:
+			if !endsWithOperand(res) {
+				// not a regexp match but ! followed by ~, as in !~a
+				res = append(res, varPendingToken(TokenNot), varPendingToken(TokenBitwiseNot))
+				break
+			}
+			res = append(res, varPendingToken(tok))
+		case TokenBracketOpen:
+			if !endsWithOperand(res) {
+				// array literal
+				list, err := p.parseList(TokenBracketClose)
+				if err != nil {
+					return nil, TokenInvalid, err
+				}
+				res = append(res, varArray(list))
+				break
+			}
+			sub, err := p.parseIndex(res[len(res)-1], false)
+			if err != nil {
+				return nil, TokenInvalid, err
 			}
-			break mainloop
+			res[len(res)-1] = sub
+		case TokenParenOpen:
+			sub, err := p.parseGroup()
+			if err != nil {
+				return nil, TokenInvalid, err
+			}
+			res = append(res, sub)
 		case TokenStringConstant:
 			sub, err := p.parseString(dat[0], "text")
 			if err != nil {
-				return nil, err
+				return nil, TokenInvalid, err
 			}
 			res = append(res, sub)
 		case TokenNumber:
-			v, ok := typutil.AsNumber(string(dat))
-			if !ok {
-				return nil, fmt.Errorf("invalid number: %s", string(dat))
+			v, err := parseNumber(string(dat))
+			if err != nil {
+				return nil, TokenInvalid, err
 			}
 			res = append(res, &staticVar{v})
 		case TokenVariable:
+			if endsWithOperand(res) {
+				// after an operand, only keyword operators are allowed
+				op, err := p.parseKeywordOperator(string(dat))
+				if err != nil {
+					return nil, TokenInvalid, err
+				}
+				res = append(res, varPendingToken(op))
+				break
+			}
+			if v, ok := keywords[string(dat)]; ok {
+				res = append(res, v)
+				break
+			}
+			p.skipSpaces()
+			if p.cur() == '(' {
+				// function call
+				p.forward()
+				sub, err := p.parseCall(string(dat))
+				if err != nil {
+					return nil, TokenInvalid, err
+				}
+				res = append(res, sub)
+				break
+			}
 			res = append(res, varFetchFromCtx(string(dat)))
 		case TokenInvalid:
-			return nil, fmt.Errorf("invalid token found, value=%v", dat)
+			return nil, TokenInvalid, fmt.Errorf("invalid token found, value=%v", dat)
 		default:
 			// unknown token, defer to step 2
 			res = append(res, varPendingToken(tok))
@@ -104,84 +271,323 @@ mainloop:
 	}
 
 	if len(res) == 0 {
-		return varNull{}, nil
+		return nil, endTok, nil
 	}
 
 	// Stage 2: Operator association
 	// Build the AST respecting operator precedence.
-	return associateOperators(res)
+	v, err := p.associateOperators(res)
+	return v, endTok, err
 }
 
-// associateOperators processes a slice of Var and pending tokens to build
-// the final AST with proper operator precedence.
-func associateOperators(res []Var) (Var, error) {
+// closingToken returns the token closing a group among ends, or TokenInvalid
+// if ends contains none.
+func closingToken(ends []Token) Token {
+	for _, end := range ends {
+		switch end {
+		case TokenParenClose, TokenBracketClose, TokenBraceClose:
+			return end
+		}
+	}
+	return TokenInvalid
+}
+
+// parseNumber converts a numeric literal read by readNumberToken to an int64,
+// uint64 (for integers too large for int64) or float64 value.
+func parseNumber(s string) (any, error) {
+	isFloat := strings.ContainsAny(s, ".eE")
+	if len(s) > 1 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		// e is a hex digit, hexadecimal floats use p as exponent
+		isFloat = strings.ContainsAny(s, ".pP")
+	}
+
+	if !isFloat {
+		v, err := strconv.ParseInt(s, 0, 64)
+		if err == nil {
+			return v, nil
+		}
+		if !errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Errorf("invalid number: %s", s)
+		}
+		if u, err := strconv.ParseUint(s, 0, 64); err == nil {
+			return u, nil
+		}
+		// too large for any integer type, fall back to float
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number: %s", s)
+	}
+	return v, nil
+}
+
+// endsWithOperand returns true if the last element of res is an operand
+// rather than a pending operator token.
+func endsWithOperand(res []Var) bool {
 	if len(res) == 0 {
-		return varNull{}, nil
+		return false
 	}
-	if len(res) == 1 {
-		return res[0], nil
+	_, isOp := res[len(res)-1].(varPendingToken)
+	return !isOp
+}
+
+// parseKeywordOperator returns the operator token for a name found after an
+// operand, such as "in" or "not in".
+func (p *parser) parseKeywordOperator(name string) (Token, error) {
+	switch name {
+	case "in":
+		return TokenIn, nil
+	case "not":
+		p.skipSpaces()
+		if tok, dat := p.readToken(); tok == TokenVariable && string(dat) == "in" {
+			return TokenNotIn, nil
+		}
+		return TokenInvalid, fmt.Errorf("invalid syntax: not must be followed by in")
 	}
+	return TokenInvalid, fmt.Errorf("invalid syntax: unexpected %s after operand", name)
+}
 
-	// Step 1: Handle leading unary operators (!, ~)
-	if tok, ok := res[0].(varPendingToken); ok {
-		t := Token(tok)
-		if t.IsUnary() {
-			inner, err := associateOperators(res[1:])
+// parseGroup parses a parenthesized expression up to the closing parenthesis.
+func (p *parser) parseGroup() (Var, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+
+	sub, _, err := p.parseExpr(TokenParenClose)
+	if err != nil {
+		return nil, err
+	}
+	if sub == nil {
+		return nil, fmt.Errorf("invalid syntax: empty parentheses")
+	}
+	return sub, nil
+}
+
+// parseAccess parses the member name following a . or ?. token and returns
+// the access on sub. After ?., an index in brackets is also accepted.
+func (p *parser) parseAccess(sub Var, optional bool) (Var, error) {
+	p.skipSpaces()
+	tok, dat := p.readToken()
+	switch tok {
+	case TokenVariable:
+		return &varAccessOffset{sub: sub, offset: string(dat), optional: optional}, nil
+	case TokenBracketOpen:
+		if optional {
+			return p.parseIndex(sub, true)
+		}
+	}
+	return nil, fmt.Errorf("invalid syntax: dot not followed by var")
+}
+
+// parseIndex parses an index expression up to the closing bracket and
+// returns the index access on sub.
+func (p *parser) parseIndex(sub Var, optional bool) (Var, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+
+	key, _, err := p.parseExpr(TokenBracketClose)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("invalid syntax: empty index")
+	}
+	return &varIndex{sub: sub, key: key, optional: optional}, nil
+}
+
+// parseFilter parses a filter name and its optional arguments following a |
+// token, and returns the filter applied to input. A | followed by a name is
+// always a filter pipe, and the filter must be registered at parse time. If
+// the | is not followed by a name, it is a bitwise OR: nil is returned and
+// the parser is left unchanged.
+func (p *parser) parseFilter(input Var) (Var, error) {
+	save := p.buf
+	p.skipSpaces()
+	tok, dat := p.readToken()
+	if tok != TokenVariable {
+		p.buf = save
+		return nil, nil
+	}
+	fn := LookupFilter(string(dat))
+	if fn == nil {
+		return nil, fmt.Errorf("unknown filter: %s", string(dat))
+	}
+	f := &varFilter{input: input, name: string(dat), fn: fn}
+
+	p.skipSpaces()
+	if p.cur() == '(' {
+		// filter arguments
+		p.forward()
+		args, err := p.parseList(TokenParenClose)
+		if err != nil {
+			return nil, err
+		}
+		f.args = args
+	}
+	return f, nil
+}
+
+// parseObject parses an object literal up to the closing brace. Keys may be
+// names, numbers or strings, and values are full expressions.
+func (p *parser) parseObject() (Var, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+
+	obj := &varObject{}
+	for {
+		p.skipSpaces()
+		if p.empty() {
+			return nil, fmt.Errorf("missing }: %w", io.ErrUnexpectedEOF)
+		}
+		tok, dat := p.readToken()
+		var key Var
+		switch tok {
+		case TokenBraceClose:
+			if len(obj.keys) == 0 {
+				// empty object
+				return obj, nil
+			}
+			return nil, fmt.Errorf("invalid syntax: missing key before }")
+		case TokenVariable, TokenNumber:
+			key = &staticVar{string(dat)}
+		case TokenStringConstant:
+			var err error
+			key, err = p.parseString(dat[0], "text")
 			if err != nil {
 				return nil, err
 			}
-			switch t {
-			case TokenNot:
-				return &varNot{inner}, nil
-			case TokenBitwiseNot:
-				return &varBitwiseNot{inner}, nil
-			}
+		default:
+			return nil, fmt.Errorf("invalid object key: %s", tok)
+		}
+
+		p.skipSpaces()
+		if tok, _ := p.readToken(); tok != TokenColon {
+			return nil, fmt.Errorf("invalid syntax: missing : after object key")
+		}
+
+		v, end, err := p.parseExpr(TokenBraceClose, TokenComma)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return nil, fmt.Errorf("invalid syntax: missing value before %s", end)
+		}
+		obj.keys = append(obj.keys, key)
+		obj.values = append(obj.values, v)
+		if end == TokenBraceClose {
+			return obj, nil
 		}
-		return nil, fmt.Errorf("unexpected token at start: %v", tok)
 	}
+}
 
-	// Step 2: First pass - handle all dot operators (highest precedence, left-to-right)
-	for i := 1; i < len(res)-1; i += 2 {
-		if tok, ok := res[i].(varPendingToken); ok && Token(tok) == TokenDot {
-			if v2, ok := res[i+1].(varFetchFromCtx); ok {
-				access := &varAccessOffset{res[i-1], string(v2)}
-				res = append(res[:i-1], append([]Var{access}, res[i+2:]...)...)
-				i -= 2 // reprocess from same position
-				if i < 1 {
-					i = -1
-				}
-			} else {
-				return nil, fmt.Errorf("invalid syntax: dot not followed by var")
+// parseCall parses the arguments of a call to the named function, up to the
+// closing parenthesis. The function must be registered.
+func (p *parser) parseCall(name string) (Var, error) {
+	fn := lookupFunction(name)
+	if fn == nil {
+		return nil, fmt.Errorf("unknown function: %s", name)
+	}
+	args, err := p.parseList(TokenParenClose)
+	if err != nil {
+		return nil, err
+	}
+	return &varCall{name: name, fn: fn, args: args}, nil
+}
+
+// parseList parses a comma-separated list of expressions up to the given
+// closing token. The opening token must already have been consumed.
+func (p *parser) parseList(end Token) ([]Var, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+
+	var list []Var
+	for {
+		v, tok, err := p.parseExpr(end, TokenComma)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			if tok == end && len(list) == 0 {
+				// empty list
+				return nil, nil
 			}
+			return nil, fmt.Errorf("invalid syntax: missing value before %s", tok)
+		}
+		list = append(list, v)
+		if tok == end {
+			return list, nil
 		}
 	}
+}
 
+// associateOperators processes a slice of Var and pending tokens to build
+// the final AST with proper operator precedence.
+func (p *parser) associateOperators(res []Var) (Var, error) {
+	if len(res) == 0 {
+		return varNull{}, nil
+	}
 	if len(res) == 1 {
+		if tok, ok := res[0].(varPendingToken); ok {
+			return nil, fmt.Errorf("missing operand for %s", Token(tok))
+		}
 		return res[0], nil
 	}
 
-	// Step 2b: Handle filter pipes (|) - when | is followed by a known filter name
-	for i := 1; i < len(res)-1; i += 2 {
-		if tok, ok := res[i].(varPendingToken); ok && Token(tok) == TokenOr {
-			if v2, ok := res[i+1].(varFetchFromCtx); ok {
-				if fn := LookupFilter(string(v2)); fn != nil {
-					filter := &varFilter{input: res[i-1], name: string(v2), fn: fn}
-					res = append(res[:i-1], append([]Var{filter}, res[i+2:]...)...)
-					i -= 2
-					if i < 1 {
-						i = -1
-					}
-					continue
-				}
+	// Step 1: Fold unary operators (!, ~, -) into their operand, right to
+	// left so that chains such as !-a work. An operator is unary when it
+	// starts the expression or directly follows another operator.
+	for i := len(res) - 1; i >= 0; i-- {
+		tok, ok := res[i].(varPendingToken)
+		if !ok {
+			continue
+		}
+		t := Token(tok)
+		if i > 0 {
+			if _, prevOp := res[i-1].(varPendingToken); !prevOp {
+				// binary operator
+				continue
 			}
 		}
+		if !t.IsUnary() && t != TokenSubtract {
+			if i == 0 {
+				return nil, fmt.Errorf("unexpected token at start: %s", t)
+			}
+			return nil, fmt.Errorf("unexpected token after operator: %s", t)
+		}
+		if i == len(res)-1 {
+			return nil, fmt.Errorf("missing operand after %s", t)
+		}
+		if _, ok := res[i+1].(varPendingToken); ok {
+			// cannot happen as tokens are processed right to left
+			return nil, fmt.Errorf("missing operand after %s", t)
+		}
+		var unary Var
+		switch t {
+		case TokenNot:
+			unary = &varNot{res[i+1]}
+		case TokenBitwiseNot:
+			unary = &varBitwiseNot{res[i+1]}
+		case TokenSubtract:
+			unary = &varNegate{res[i+1]}
+		}
+		res = append(res[:i], append([]Var{unary}, res[i+2:]...)...)
 	}
 
 	if len(res) == 1 {
 		return res[0], nil
 	}
 
-	// Step 3: Find the lowest precedence operator (rightmost for left-associativity)
+	// At this point operands and binary operators must alternate
+	for i, v := range res {
+		if _, isOp := v.(varPendingToken); isOp != (i%2 == 1) {
+			return nil, fmt.Errorf("invalid syntax: missing operator")
+		}
+	}
+	if len(res)%2 == 0 {
+		return nil, fmt.Errorf("missing operand after %s", Token(res[len(res)-1].(varPendingToken)))
+	}
+
+	// Step 2: Find the lowest precedence operator (rightmost for left-associativity)
 	// Lower precedence number = binds tighter, so we want highest precedence number
 	lowestPrecIdx := -1
 	lowestPrec := -1
@@ -202,21 +608,110 @@ func associateOperators(res []Var) (Var, error) {
 	tok := res[lowestPrecIdx].(varPendingToken)
 	t := Token(tok)
 
+	if t == TokenQuestion || t == TokenColon {
+		// conditionals are right-associative and need special handling
+		return p.associateConditional(res)
+	}
+
 	// Build left and right subtrees
-	left, err := associateOperators(res[:lowestPrecIdx])
+	left, err := p.associateOperators(res[:lowestPrecIdx])
 	if err != nil {
 		return nil, err
 	}
-	right, err := associateOperators(res[lowestPrecIdx+1:])
+	right, err := p.associateOperators(res[lowestPrecIdx+1:])
 	if err != nil {
 		return nil, err
 	}
 
+	if t == TokenCoalesce {
+		return &varCoalesce{left, right}, nil
+	}
+
+	if t == TokenLogicAnd || t == TokenLogicOr {
+		return &varLogic{a: left, b: right, op: t.MathOp(), value: p.valueLogic}, nil
+	}
+
+	if t == TokenIn || t == TokenNotIn {
+		return &varIn{needle: left, haystack: right, not: t == TokenNotIn}, nil
+	}
+
+	if t == TokenMatch || t == TokenNotMatch {
+		m := &varMatch{sub: left, pattern: right, not: t == TokenNotMatch}
+		if right.IsStatic() {
+			// compile constant patterns once
+			pattern, err := right.Resolve(context.Background())
+			if err != nil {
+				return nil, err
+			}
+			str, err := regexpPattern(pattern)
+			if err != nil {
+				return nil, err
+			}
+			m.re, err = regexp.Compile(str)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression: %w", err)
+			}
+		}
+		return m, nil
+	}
+
 	if math := t.MathOp(); math != "" {
 		return &varMath{left, right, math}, nil
 	}
 
-	return nil, fmt.Errorf("unexpected operator: %v", tok)
+	return nil, fmt.Errorf("unexpected operator: %s", t)
+}
+
+// associateConditional builds a conditional (cond ? a : b) from res, which
+// must contain a ? operator at the lowest precedence level. The expression is
+// split on the leftmost ? and its matching :, so that nested conditionals
+// associate to the right.
+func (p *parser) associateConditional(res []Var) (Var, error) {
+	q := -1
+	for i := 1; i < len(res) && q == -1; i += 2 {
+		switch Token(res[i].(varPendingToken)) {
+		case TokenQuestion:
+			q = i
+		case TokenColon:
+			return nil, fmt.Errorf("unexpected token : without matching ?")
+		}
+	}
+	if q == -1 {
+		return nil, fmt.Errorf("invalid syntax: no conditional found")
+	}
+
+	// find the matching colon, skipping over nested conditionals
+	c := -1
+	depth := 0
+	for i := q + 2; i < len(res) && c == -1; i += 2 {
+		switch Token(res[i].(varPendingToken)) {
+		case TokenQuestion:
+			depth++
+		case TokenColon:
+			if depth == 0 {
+				c = i
+			} else {
+				depth--
+			}
+		}
+	}
+	if c == -1 {
+		return nil, fmt.Errorf("missing : in conditional expression")
+	}
+
+	cond, err := p.associateOperators(res[:q])
+	if err != nil {
+		return nil, err
+	}
+	yes, err := p.associateOperators(res[q+1 : c])
+	if err != nil {
+		return nil, err
+	}
+	no, err := p.associateOperators(res[c+1:])
+	if err != nil {
+		return nil, err
+	}
+	return &varConditional{cond: cond, yes: yes, no: no}, nil
 }
 
 // parseString parses a string literal or template string.
@@ -226,26 +721,128 @@ func associateOperators(res []Var) (Var, error) {
 //   - '"', '\'', '`': parse until matching quote (for quoted strings)
 //
 // The mode parameter controls variable handling ("text" or "json").
-// Supports escape sequences (in double-quoted strings) and nested {{}} expressions.
+// Supports escape sequences (in double-quoted strings) and nested variable
+// expressions between the parser delimiters. A backslash before the opening
+// delimiter outputs it literally, the contents of {{raw}}...{{endraw}}
+// blocks are output verbatim, and {{/* comments */}} produce no output.
+// Tags starting with "{{- " or ending with " -}}" remove the whitespace
+// preceding or following them in the literal text. Blocks such as
+// {{if cond}}...{{else}}...{{end}} are parsed into a single Var.
 func (p *parser) parseString(cut rune, mode string) (Var, error) {
+	v, _, err := p.parseBody(cut, mode, "")
+	return v, err
+}
+
+// parseBody parses a string as parseString does, within the given block
+// ("" at the top level). Parsing stops at cut, or at a tag ending the
+// current block which is returned: "end", "else" or "else if". The end and
+// else tags are consumed, while for "else if" the condition is left in the
+// buffer.
+func (p *parser) parseBody(cut rune, mode string, block string) (Var, string, error) {
 	var str []rune // accumulator for literal characters
 	var res []Var  // result Var objects (static strings and variables)
+	var tag string // tag ending the block
 
 mainloop:
 	for {
+		if p.hasPrefix(p.open) {
+			p.forwardN(len(p.open))
+			if p.readTrimMarker() {
+				str = trimSpaceRight(str)
+			}
+			if p.readKeyword("raw") {
+				// raw block, contents are kept verbatim
+				p.skipTrimmed()
+				raw, err := p.readRaw()
+				if err != nil {
+					return nil, "", err
+				}
+				str = append(str, raw...)
+				p.skipTrimmed()
+				continue
+			}
+			if ok, err := p.readComment(); err != nil {
+				return nil, "", err
+			} else if ok {
+				// comments produce nothing
+				p.skipTrimmed()
+				continue
+			}
+			if tag = p.readBlockEnd(); tag != "" {
+				if block == "" {
+					return nil, "", fmt.Errorf("invalid syntax: unexpected %s without matching block", tag)
+				}
+				break
+			}
+			// we have a string, flush it
+			if len(str) > 0 {
+				res = append(res, &staticVar{string(str)})
+				str = nil
+			}
+			if p.readTagStart("if") {
+				sub, err := p.parseIf(cut, mode)
+				if err != nil {
+					return nil, "", err
+				}
+				res = append(res, sub)
+				p.skipTrimmed()
+				continue
+			}
+			if p.readTagStart("for") {
+				sub, err := p.parseFor(cut, mode)
+				if err != nil {
+					return nil, "", err
+				}
+				res = append(res, sub)
+				p.skipTrimmed()
+				continue
+			}
+			if p.readTagStart("set") {
+				// the binding applies to the rest of the body
+				sub, endTag, err := p.parseSet(cut, mode, block)
+				if err != nil {
+					return nil, "", err
+				}
+				res = append(res, sub)
+				tag = endTag
+				break
+			}
+			// parse subvar
+			sub, err := p.parse(true)
+			if err != nil {
+				return nil, "", err
+			}
+			if mode == "json" {
+				// if json mode, encode any subvar as json
+				sub = &varJsonMarshal{sub}
+			}
+			res = append(res, sub)
+			p.skipTrimmed()
+			continue
+		}
+
 		c := p.take()
 		if c == cut {
 			// reached the end of the string
+			if block != "" {
+				return nil, "", fmt.Errorf("unterminated %s block: %w", block, io.ErrUnexpectedEOF)
+			}
 			break
 		}
 		if c == -1 {
 			// unexpected end of string
-			return nil, io.ErrUnexpectedEOF
+			return nil, "", io.ErrUnexpectedEOF
 		}
 
 		switch c {
 		case '\\':
 			// escape char
+			if p.hasPrefix(p.open) {
+				// escaped delimiter, output as is
+				str = append(str, p.open...)
+				p.forwardN(len(p.open))
+				continue mainloop
+			}
 			nc := p.cur()
 			if nc == cut && cut != -1 {
 				str = append(str, nc)
@@ -253,11 +850,12 @@ mainloop:
 				continue mainloop
 			}
 			if cut == '"' {
-				if n, ok := escapedChars[nc]; ok {
-					str = append(str, n)
-					p.forward()
-					continue mainloop
+				n, err := p.readEscape()
+				if err != nil {
+					return nil, "", err
 				}
+				str = append(str, n)
+				continue mainloop
 			}
 			if nc == '\\' {
 				str = append(str, nc)
@@ -265,26 +863,6 @@ mainloop:
 				continue mainloop
 			}
 			// not a matching thing, just include the \ character to the output
-		case '{':
-			if p.cur() == '{' {
-				// we have a string, flush it
-				if len(str) > 0 {
-					res = append(res, &staticVar{string(str)})
-					str = nil
-				}
-				p.forward()
-				// parse subvar
-				sub, err := p.parse(true)
-				if err != nil {
-					return nil, err
-				}
-				if mode == "json" {
-					// if json mode, encode any subvar as json
-					sub = &varJsonMarshal{sub}
-				}
-				res = append(res, sub)
-				continue mainloop
-			}
 		}
 
 		// nothing happened
@@ -296,10 +874,356 @@ mainloop:
 		str = nil
 	}
 	if len(res) == 1 {
-		return res[0], nil
+		return res[0], tag, nil
+	}
+
+	return varConcat(res), tag, nil
+}
+
+// parseIf parses an if block after the if keyword, up to and including its
+// end tag. Each branch is parsed with parseBody, and may contain other blocks.
+func (p *parser) parseIf(cut rune, mode string) (Var, error) {
+	res := &varIf{}
+	for {
+		cond, err := p.parseTagExpr("if")
+		if err != nil {
+			return nil, err
+		}
+		p.skipTrimmed()
+		body, tag, err := p.parseBody(cut, mode, "if")
+		if err != nil {
+			return nil, err
+		}
+		res.conds = append(res.conds, cond)
+		res.bodies = append(res.bodies, body)
+
+		switch tag {
+		case "else if":
+			continue
+		case "else":
+			p.skipTrimmed()
+			body, tag, err = p.parseBody(cut, mode, "if")
+			if err != nil {
+				return nil, err
+			}
+			if tag != "end" {
+				return nil, fmt.Errorf("invalid syntax: unexpected %s after else in if block", tag)
+			}
+			res.bodies = append(res.bodies, body)
+		}
+		return res, nil
+	}
+}
+
+// parseFor parses a for block after the for keyword, up to and including its
+// end tag. The loop is written as "for value in expr" or "for key, value in
+// expr", and may have an else body used when the collection is empty.
+func (p *parser) parseFor(cut rune, mode string) (Var, error) {
+	res := &varFor{}
+	name, err := p.readVarName("for")
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.cur() == ',' {
+		p.forward()
+		res.key = name
+		name, err = p.readVarName("for")
+		if err != nil {
+			return nil, err
+		}
+	}
+	res.value = name
+	if !p.readTagStart("in") {
+		return nil, errors.New("invalid syntax: expected in after for variables")
+	}
+	res.sub, err = p.parseTagExpr("in")
+	if err != nil {
+		return nil, err
+	}
+	p.skipTrimmed()
+
+	body, tag, err := p.parseBody(cut, mode, "for")
+	if err != nil {
+		return nil, err
+	}
+	res.body = body
+
+	switch tag {
+	case "else if":
+		return nil, errors.New("invalid syntax: unexpected else if in for block")
+	case "else":
+		p.skipTrimmed()
+		res.empty, tag, err = p.parseBody(cut, mode, "for")
+		if err != nil {
+			return nil, err
+		}
+		if tag != "end" {
+			return nil, fmt.Errorf("invalid syntax: unexpected %s after else in for block", tag)
+		}
+	}
+	return res, nil
+}
+
+// parseSet parses a set tag after the set keyword, written as "set name =
+// expr", followed by the rest of the body of the given block. It returns the
+// tag ending the block as parseBody does.
+func (p *parser) parseSet(cut rune, mode string, block string) (Var, string, error) {
+	name, err := p.readVarName("set")
+	if err != nil {
+		return nil, "", err
+	}
+	p.skipSpaces()
+	if p.cur() != '=' || p.next() == '=' {
+		return nil, "", errors.New("invalid syntax: expected = after set variable")
+	}
+	p.forward()
+	value, err := p.parseTagExpr("=")
+	if err != nil {
+		return nil, "", err
+	}
+	p.skipTrimmed()
+
+	body, tag, err := p.parseBody(cut, mode, block)
+	if err != nil {
+		return nil, "", err
+	}
+	return &varSet{name: name, value: value, body: body}, tag, nil
+}
+
+// readVarName reads the name of a variable bound by the given tag.
+func (p *parser) readVarName(tag string) (string, error) {
+	p.skipSpaces()
+	if c := p.cur(); !unicode.IsLetter(c) && c != '_' {
+		return "", fmt.Errorf("invalid syntax: expected variable name after %s", tag)
+	}
+	name := string(p.readVariableToken())
+	if _, ok := keywords[name]; ok {
+		return "", fmt.Errorf("invalid syntax: %s cannot be used as a variable name", name)
+	}
+	return name, nil
+}
+
+// parseTagExpr parses the expression of a block tag such as {{if cond}},
+// up to and including the closing delimiter. The expression is required.
+func (p *parser) parseTagExpr(tag string) (Var, error) {
+	p.skipSpaces()
+	if p.readClose() {
+		return nil, fmt.Errorf("invalid syntax: missing expression after %s", tag)
+	}
+	return p.parse(true)
+}
+
+// readBlockEnd checks if the buffer, after the opening delimiter, contains a
+// tag ending a block: "end", "else" or "else if". The end and else tags are
+// consumed including the closing delimiter, while for "else if" only the
+// keywords are. If there is no such tag, "" is returned and the parser is
+// left unchanged.
+func (p *parser) readBlockEnd() string {
+	if p.readKeyword("end") {
+		return "end"
 	}
+	if p.readKeyword("else") {
+		return "else"
+	}
+	save := p.buf
+	if p.readTagStart("else") && p.readTagStart("if") {
+		return "else if"
+	}
+	p.buf = save
+	return ""
+}
+
+// readKeyword checks if the buffer, after the opening delimiter, contains the
+// given keyword alone followed by the closing delimiter (e.g. "raw }}"). If
+// so, it is consumed and true is returned. Otherwise the parser is left
+// unchanged.
+func (p *parser) readKeyword(word string) bool {
+	save := p.buf
+	p.skipSpaces()
+	if p.hasPrefix([]rune(word)) {
+		p.forwardN(len(word))
+		p.skipSpaces()
+		if p.readClose() {
+			return true
+		}
+	}
+	p.buf = save
+	return false
+}
 
-	return varConcat(res), nil
+// readTagStart checks if the buffer, after the opening delimiter, starts
+// with the given keyword followed by whitespace or a parenthesis (e.g.
+// "if cond"). If so, the keyword is consumed and true is returned. Otherwise
+// the parser is left unchanged.
+func (p *parser) readTagStart(word string) bool {
+	save := p.buf
+	p.skipSpaces()
+	if p.hasPrefix([]rune(word)) {
+		p.forwardN(len(word))
+		if c := p.cur(); unicode.IsSpace(c) || c == '(' {
+			return true
+		}
+	}
+	p.buf = save
+	return false
+}
+
+// readRaw reads the contents of a raw block up to the matching endraw tag,
+// which is consumed.
+func (p *parser) readRaw() ([]rune, error) {
+	var res []rune
+	for !p.empty() {
+		if p.hasPrefix(p.open) {
+			save := p.buf
+			p.forwardN(len(p.open))
+			trim := p.readTrimMarker()
+			if p.readKeyword("endraw") {
+				if trim {
+					res = trimSpaceRight(res)
+				}
+				return res, nil
+			}
+			p.buf = save
+		}
+		res = append(res, p.take())
+	}
+	return nil, fmt.Errorf("unterminated raw block: %w", io.ErrUnexpectedEOF)
+}
+
+// readComment checks if the buffer, after the opening delimiter, contains a
+// comment such as "/* text */}}" and consumes it. Comments may span multiple
+// lines, and must be followed by the closing delimiter. If there is no
+// comment, false is returned and the parser is left unchanged.
+func (p *parser) readComment() (bool, error) {
+	save := p.buf
+	p.skipSpaces()
+	if !p.hasPrefix([]rune("/*")) {
+		p.buf = save
+		return false, nil
+	}
+	p.forward2()
+
+	for !p.hasPrefix([]rune("*/")) {
+		if p.empty() {
+			return false, fmt.Errorf("unterminated comment: %w", io.ErrUnexpectedEOF)
+		}
+		p.forward()
+	}
+	p.forward2()
+	p.skipSpaces()
+	if !p.readClose() {
+		return false, fmt.Errorf("invalid syntax: comment must be followed by %s", string(p.close))
+	}
+	return true, nil
+}
+
+// readTrimMarker checks if the buffer, after the opening delimiter, starts
+// with a trim marker (a - followed by whitespace) and consumes it.
+func (p *parser) readTrimMarker() bool {
+	if p.cur() == '-' && unicode.IsSpace(p.next()) {
+		p.forward()
+		return true
+	}
+	return false
+}
+
+// readClose consumes the closing delimiter, optionally preceded by a trim
+// marker (whitespace and -) in which case the whitespace following the tag
+// will be skipped by skipTrimmed. It returns false if the buffer does not
+// start with either.
+func (p *parser) readClose() bool {
+	if p.cur() == '-' && unicode.IsSpace(p.prev()) {
+		save := p.buf
+		p.forward()
+		if p.hasPrefix(p.close) {
+			p.forwardN(len(p.close))
+			p.trim = true
+			return true
+		}
+		p.buf = save
+	}
+	if p.hasPrefix(p.close) {
+		p.forwardN(len(p.close))
+		return true
+	}
+	return false
+}
+
+// skipTrimmed skips whitespace following a tag that ended with a trim marker.
+func (p *parser) skipTrimmed() {
+	if p.trim {
+		p.trim = false
+		p.skipSpaces()
+	}
+}
+
+// trimSpaceRight removes trailing whitespace from str.
+func trimSpaceRight(str []rune) []rune {
+	for len(str) > 0 && unicode.IsSpace(str[len(str)-1]) {
+		str = str[:len(str)-1]
+	}
+	return str
+}
+
+// readEscape reads an escape sequence in a double-quoted string, after the
+// backslash. In addition to escapedChars, it supports \xNN, \uNNNN and
+// \UNNNNNNNN hexadecimal escapes, as well as octal escapes of up to three
+// digits such as \0 or \033. Hexadecimal and octal escapes produce the
+// character with the given code point.
+func (p *parser) readEscape() (rune, error) {
+	c := p.take()
+	if n, ok := escapedChars[c]; ok {
+		return n, nil
+	}
+
+	switch c {
+	case 'x':
+		return p.readEscapeDigits(c, 2, 16)
+	case 'u':
+		return p.readEscapeDigits(c, 4, 16)
+	case 'U':
+		return p.readEscapeDigits(c, 8, 16)
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		// octal escape, up to 3 digits
+		v := c - '0'
+		for i := 0; i < 2 && p.cur() >= '0' && p.cur() <= '7'; i++ {
+			v = v*8 + p.take() - '0'
+		}
+		if v > 0xff {
+			return 0, fmt.Errorf("invalid octal escape sequence: value %d out of range", v)
+		}
+		return v, nil
+	case -1:
+		return 0, io.ErrUnexpectedEOF
+	}
+	return 0, fmt.Errorf("invalid escape sequence: \\%c", c)
+}
+
+// readEscapeDigits reads exactly n digits in the given base for the escape
+// sequence started by c, and returns the resulting character.
+func (p *parser) readEscapeDigits(c rune, n int, base int) (rune, error) {
+	var v rune
+	for i := 0; i < n; i++ {
+		d := p.cur()
+		var dv rune
+		switch {
+		case d >= '0' && d <= '9':
+			dv = d - '0'
+		case d >= 'a' && d <= 'f':
+			dv = d - 'a' + 10
+		case d >= 'A' && d <= 'F':
+			dv = d - 'A' + 10
+		default:
+			return 0, fmt.Errorf("invalid escape sequence \\%c: expected %d hexadecimal digits", c, n)
+		}
+		p.forward()
+		v = v*rune(base) + dv
+	}
+	if !utf8.ValidRune(v) {
+		return 0, fmt.Errorf("invalid escape sequence \\%c: invalid code point %X", c, v)
+	}
+	return v, nil
 }
 
 // cur returns the current rune without consuming it, or -1 if at end.
@@ -322,6 +1246,28 @@ func (p *parser) forward() {
 	}
 }
 
+// forwardN advances the parser by n runes.
+func (p *parser) forwardN(n int) {
+	if len(p.buf) > n {
+		p.buf = p.buf[n:]
+	} else {
+		p.buf = nil
+	}
+}
+
+// hasPrefix returns true if the buffer starts with the runes in s.
+func (p *parser) hasPrefix(s []rune) bool {
+	if len(p.buf) < len(s) {
+		return false
+	}
+	for i, r := range s {
+		if p.buf[i] != r {
+			return false
+		}
+	}
+	return true
+}
+
 // forward2 advances the parser by two runes (used for two-character tokens like == or &&).
 func (p *parser) forward2() {
 	if len(p.buf) > 1 {
@@ -341,6 +1287,15 @@ func (p *parser) take() rune {
 	return r
 }
 
+// prev returns the rune before the current one, or -1 if unavailable.
+func (p *parser) prev() rune {
+	pos := len(p.src) - len(p.buf)
+	if pos < 1 {
+		return -1
+	}
+	return p.src[pos-1]
+}
+
 // next returns the rune after the current one (lookahead), or -1 if unavailable.
 func (p *parser) next() rune {
 	if len(p.buf) < 2 {
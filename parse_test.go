@@ -2,6 +2,7 @@ package replvar_test
 
 import (
 	"context"
+	"strings"
 	"testing"
 
 	"github.com/KarpelesLab/replvar"
@@ -16,6 +17,12 @@ func TestParser(t *testing.T) {
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, "var", "world")
 	ctx = context.WithValue(ctx, "var2", map[string]any{"foo": "bar", "num": 40})
+	ctx = context.WithValue(ctx, "items", []any{map[string]any{"name": "first"}, map[string]any{"name": "second"}})
+	ctx = context.WithValue(ctx, "nums", []int{10, 20, 30})
+	ctx = context.WithValue(ctx, "headers", map[string]string{"Content-Type": "text/html"})
+	ctx = context.WithValue(ctx, "prices", map[string]any{"EUR": 10, "USD": 12})
+	ctx = context.WithValue(ctx, "codes", map[int]string{404: "Not Found"})
+	ctx = context.WithValue(ctx, "currency", "USD")
 
 	testV := []*testVector{
 		// Basic variable substitution
@@ -24,6 +31,70 @@ func TestParser(t *testing.T) {
 		&testVector{"hello {{'world'}}", "hello world"},
 		&testVector{"hello {{`world 2\\t`}}", "hello world 2\\t"},
 		&testVector{"hello {{\"world \\t\"}}", "hello world \t"},
+		// Escape sequences in double-quoted strings
+		&testVector{"{{\"\\u00e9t\\u00C9\"}}", "\u00e9t\u00c9"},
+		&testVector{"{{\"\\U0001F600\"}}", "\U0001F600"},
+		&testVector{"{{\"\\x1b[0m\"}}", "\x1b[0m"},
+		&testVector{"{{\"say \\\"hi\\\" \\'there\\'\"}}", "say \"hi\" 'there'"},
+		&testVector{"{{\"\\a\\b\\f\\v\\\\\"}}", "\a\b\f\v\\"},
+		&testVector{"{{\"a\\0b\"}}", "a\x00b"},
+		&testVector{"{{\"\\033\\101\\1010\"}}", "\x1bAA0"},
+		&testVector{"{{'\\n stays'}}", "\\n stays"},
+		// Escaped delimiters and raw blocks
+		&testVector{"\\{{var}} {{var}}", "{{var}} world"},
+		&testVector{"a \\\\{{var}}", "a \\world"},
+		&testVector{"a \\} \\{ {{var}}", "a \\} \\{ world"},
+		&testVector{"{{\"\\{{var}}\"}} {{'\\{{var}}'}}", "{{var}} {{var}}"},
+		&testVector{"{{raw}}{{var}} {{ 1 + }}{{endraw}}!", "{{var}} {{ 1 + }}!"},
+		&testVector{"{{ raw }}a{{raw}}b{{ endraw }}{{var}}", "a{{raw}}bworld"},
+		&testVector{"{{rawvar ?? 'x'}}", "x"},
+		// Comments
+		&testVector{"a{{/* comment */}}b", "ab"},
+		&testVector{"a{{ /* multi\nline {{var}} }} */ }}b{{var}}", "abworld"},
+		&testVector{"{{/**/}}", ""},
+		&testVector{"{{/* a */}}{{/* b */}}", ""},
+		// Whitespace trimming
+		&testVector{"a  {{- var -}}  b", "aworldb"},
+		&testVector{"a \n {{- var }} \n b", "aworld \n b"},
+		&testVector{"a \n {{ var -}} \n b", "a \n worldb"},
+		&testVector{"<ul>\n  {{- /* comment */ -}}\n</ul>", "<ul></ul>"},
+		&testVector{"a {{- raw -}} {{x}} {{- endraw -}} b", "a{{x}}b"},
+		&testVector{"{{-5}} {{ 3 -2 }} {{2 - 1 -}} !", "-5 1 1!"},
+		&testVector{"{{- var -}}", "world"},
+		// Boolean and null keywords
+		&testVector{"{{true}} {{false}} {{null}} {{nil}}", "1 0  "},
+		&testVector{"{{missing == null}} {{missing != nil}}", "1 0"},
+		&testVector{"{{var == null}} {{var2.num == null}} {{0 == null}} {{'' == null}}", "0 0 0 0"},
+		&testVector{"{{null == nil}} {{null == false}}", "1 0"},
+		&testVector{"{{var == true}} {{0 == false}} {{'' == false}} {{1 == true}} {{true == 1}}", "1 1 1 1 1"},
+		&testVector{"{{var2.num == false}} {{true != false}}", "0 1"},
+		&testVector{"{{!true || false ? 'a' : 'b'}}", "b"},
+		&testVector{"{{null ?? 'default'}} {{false ?? 'x'}}", "default 0"},
+		&testVector{"{{ {'true': 1}.true }} {{ {true: 2}['true'] }}", "1 2"},
+		// Membership
+		&testVector{"{{'paid' in ['paid', 'shipped']}}", "1"},
+		&testVector{"{{'new' in ['paid', 'shipped']}}", "0"},
+		&testVector{"{{'new' not in ['paid', 'shipped']}}", "1"},
+		&testVector{"{{'or' in var}} {{'x' in var}} {{'x' not  in var}}", "1 0 1"},
+		&testVector{"{{'foo' in var2}} {{'nope' in var2}}", "1 0"},
+		&testVector{"{{20 in nums}} {{'30' in nums}} {{25 in nums}}", "1 1 0"},
+		&testVector{"{{'Content-Type' in headers}} {{404 in codes}} {{405 in codes}}", "1 1 0"},
+		&testVector{"{{'x' in missing}}", "0"},
+		&testVector{"{{1 + 1 in [2, 3] && 4 in [4]}}", "1"},
+		&testVector{"{{var2.num in [40] ? 'yes' : 'no'}}", "yes"},
+		&testVector{"{{[1] in [[1]]}} {{nums in [[10, 20, 30]]}} {{[2] in [[1]]}}", "1 1 0"},
+		&testVector{"{{missing in 'a<nil>b'}} {{missing in {'<nil>': 1} }} {{missing in headers}} {{missing in codes}}", "0 0 0 0"},
+		&testVector{"{{null in [1, null]}} {{missing in ''}}", "1 0"},
+		&testVector{"{{ {in: 1}.in }}", "1"},
+		// Regular expressions
+		&testVector{"{{var =~ '^wor'}} {{var =~ '^or'}}", "1 0"},
+		&testVector{"{{var !~ '^wor'}} {{var !~ '^or'}}", "0 1"},
+		&testVector{"{{'SKU-1234' =~ `^SKU-\\d{4}$`}}", "1"},
+		&testVector{"{{var2.foo =~ var2.foo}} {{var =~ concat('^', var2.foo)}}", "1 0"},
+		&testVector{"{{var =~ 'o' && var2.foo =~ 'a'}}", "1"},
+		&testVector{"{{var =~ 'x' ? 'yes' : 'no'}}", "no"},
+		&testVector{"{{missing =~ '^$'}}", "1"},
+		&testVector{"{{!~0}} {{!~0 == false}}", "0 1"},
 		// Field access
 		&testVector{"hello {{var2.foo}}", "hello bar"},
 		&testVector{"hello {{  var2  .   foo   }}", "hello bar"},
@@ -50,17 +121,197 @@ func TestParser(t *testing.T) {
 		&testVector{"{{1 << 4}}", "16"},
 		&testVector{"{{16 >> 2}}", "4"},
 		// Logical operators with precedence
-		&testVector{"{{1 || 0 && 0}}", "1"},  // && binds tighter than ||
+		&testVector{"{{1 || 0 && 0}}", "1"}, // && binds tighter than ||
 		&testVector{"{{0 || 1 && 1}}", "1"},
+		// Short-circuit evaluation
+		&testVector{"{{missing && missing.name == 'x'}}", "0"},
+		&testVector{"{{var || missing.name}}", "1"},
+		&testVector{"{{var2 && var2.foo == 'bar'}}", "1"},
+		&testVector{"{{!missing || missing.name}}", "1"},
+		&testVector{"{{0 && nosuch.field || 1}}", "1"},
 		// Bitwise operators
 		&testVector{"{{5 | 3}}", "7"},
 		&testVector{"{{5 & 3}}", "1"},
 		&testVector{"{{5 ^ 3}}", "6"},
+		// Numeric literals
+		&testVector{"{{0xFF}}", "255"},
+		&testVector{"{{0XfF - 1}}", "254"},
+		&testVector{"{{var2.num & 0x0F}}", "8"},
+		&testVector{"{{0b1010}}", "10"},
+		&testVector{"{{0o17 + 017}}", "30"},
+		&testVector{"{{1_000_000}}", "1000000"},
+		&testVector{"{{0x_FF_FF}}", "65535"},
+		&testVector{"{{1e3 == 1000}}", "1"},
+		&testVector{"{{2.5E+1 == 25}}", "1"},
+		&testVector{"{{1e2-1 == 99}}", "1"},
+		&testVector{"{{0x1p4 == 16}}", "1"},
+		&testVector{"{{1_000.5 * 2 == 2001}}", "1"},
+		&testVector{"{{18446744073709551615}}", "18446744073709551615"},
+		&testVector{"{{18446744073709551615 > 1}} {{18446744073709551615 > 9223372036854775807}} {{-1 < 18446744073709551615}}", "1 1 1"},
+		&testVector{"{{18446744073709551615 == max(18446744073709551615, 1, 2.5)}}", "1"},
+		&testVector{"{{0xFFFFFFFFFFFFFFFF >> 60}} {{0x8000000000000000 << 1}}", "15 0"},
+		&testVector{"{{-9223372036854775808}} {{-18446744073709551615 < 0}}", "-9223372036854775808 1"},
+		&testVector{"{{-9223372036854775808}}", "-9223372036854775808"},
+		// Parenthesized groups
+		&testVector{"{{(2 + 3) * 4}}", "20"},
+		&testVector{"{{2 * (3 + 4) * 5}}", "70"},
+		&testVector{"{{((1 + 2) * (3 + 4))}}", "21"},
+		&testVector{"{{(((var2.num)))}}", "40"},
+		&testVector{"{{(var2).foo}}", "bar"},
+		&testVector{"{{10 - (2 - (3 - 1))}}", "10"},
+		&testVector{"{{!(1 && 0)}}", "1"},
+		// Unary minus
+		&testVector{"{{-5}}", "-5"},
+		&testVector{"{{-var2.num}}", "-40"},
+		&testVector{"{{var2.num * -1}}", "-40"},
+		&testVector{"{{2 - -3}}", "5"},
+		&testVector{"{{-2 * 3 + 10}}", "4"},
+		&testVector{"{{-(2 + 3)}}", "-5"},
+		&testVector{"{{--4}}", "4"},
+		&testVector{"{{-1.5 + 1}}", "-0.5"},
+		&testVector{"{{!0 && 0}}", "0"}, // ! binds tighter than &&, this used to be !(0 && 0)
+		&testVector{"{{!(0 && 0)}}", "1"},
+		&testVector{"{{1 + ~0}}", "0"},
+		// Conditional operator
+		&testVector{"{{var2.num == 40 ? 'yes' : 'no'}}", "yes"},
+		&testVector{"{{var2.num == 1 ? 'item' : 'items'}}", "items"},
+		&testVector{"{{0 ? 1 : 0 ? 2 : 3}}", "3"},
+		&testVector{"{{1 ? 0 ? 2 : 3 : 4}}", "3"},
+		&testVector{"{{1 || 0 ? 'a' : 'b'}}", "a"},
+		&testVector{"{{(1 ? 2 : 3) + 1}}", "3"},
+		&testVector{"{{1 ? var : var2.missing.field}}", "world"},
+		// Null-coalescing
+		&testVector{"{{var2.nickname ?? var2.foo}}", "bar"},
+		&testVector{"{{var2.nickname ?? var2.name ?? 'anonymous'}}", "anonymous"},
+		&testVector{"{{var2.num ?? 'none'}}", "40"},
+		&testVector{"{{missing ?? 0}}", "0"},
+		&testVector{"{{var ?? var2.missing.field}}", "world"},
+		&testVector{"{{missing ?? 1 ? 'a' : 'b'}}", "a"},
+		&testVector{"{{missing ?? 2 + 3}}", "5"},
+		// missing and null values render as empty strings
+		&testVector{"{{missing}}", ""},
+		&testVector{"[{{missing}}]", "[]"},
+		&testVector{"[{{missing|upper}}] [{{missing|html}}]", "[] []"},
+		&testVector{"[{{concat('a', missing)}}]", "[a]"},
+		// Optional chaining
+		&testVector{"{{var2?.foo}}", "bar"},
+		&testVector{"{{var2.missing?.field}}", ""},
+		&testVector{"{{var2.missing?.field?.deeper}}", ""},
+		&testVector{"{{var?.field}}", ""},
+		&testVector{"{{missing?.field ?? 'none'}}", "none"},
+		&testVector{"{{missing?.field.deeper.deepest}}", ""},
+		&testVector{"{{var2.missing?.field.deeper ?? 'none'}}", "none"},
+		&testVector{"{{missing?.[0].name}} {{missing?.list[0]}}", " "},
+		&testVector{"{{missing?.[var2.foo.field]}}", ""},
+		// Index access
+		&testVector{"{{items[0].name}}", "first"},
+		&testVector{"{{items[1]['name']}}", "second"},
+		&testVector{"{{items[-1].name}}", "second"},
+		&testVector{"{{items[5]?.name ?? 'none'}}", "none"},
+		&testVector{"{{nums[1] + nums[-1]}}", "50"},
+		&testVector{"{{nums[1 + 1]}}", "30"},
+		&testVector{"{{nums[3]}}", ""},
+		&testVector{"{{headers['Content-Type']}}", "text/html"},
+		&testVector{"{{prices[currency]}}", "12"},
+		&testVector{"{{prices[currency] * -nums[0]}}", "-120"},
+		&testVector{"{{codes[404]}}", "Not Found"},
+		&testVector{"[{{ {'<nil>': 1}[missing] }}{{headers[missing]}}{{codes[missing]}}]", "[]"},
+		&testVector{"{{var2['foo']}}", "bar"},
+		&testVector{"{{missing?.[0]}}", ""},
+		&testVector{"{{var2 . foo}}", "bar"},
+		// Function calls
+		&testVector{"{{max(2, var2.num)}}", "40"},
+		&testVector{"{{min(2, var2.num, -3)}}", "-3"},
+		&testVector{"{{max(1.5, 1)}}", "1.5"},
+		&testVector{"{{concat(var, ' ', var2.foo)}}", "world bar"},
+		&testVector{"{{concat()}}", ""},
+		&testVector{"{{max(1, min(5, 3)) * 2}}", "6"},
+		&testVector{"{{max (1, 2)}}", "2"},
+		&testVector{"{{concat(items[1].name, '!')}}", "second!"},
+		// Array literals
+		&testVector{"{{[1, 'a', var2.foo]|json}}", `[1,"a","bar"]`},
+		&testVector{"{{[]|json}}", `[]`},
+		&testVector{"{{[[1, 2], [3]]|json}}", `[[1,2],[3]]`},
+		&testVector{"{{['a', 'b', 'c'][1]}}", "b"},
+		&testVector{"{{[10, 20, 30][-1] + 1}}", "31"},
+		&testVector{"{{max([1, 2][0], 5)}}", "5"},
+		&testVector{"{{[1] == [1]}} {{[[1]] == [[1]]}} {{[1] != [1]}}", "1 1 0"},
+		&testVector{"{{[1, [2]] == [1, ['2']]}} {{[1] == [1, 2]}} {{[1] == [2]}} {{[] == []}}", "1 0 0 1"},
+		&testVector{"{{nums == [10, 20, 30]}} {{[1] == 1}} {{[1] == '1'}}", "1 0 0"},
+		// Object literals
+		&testVector{"{{ {'id': var2.num, 'name': var2.foo} | json }}", `{"id":40,"name":"bar"}`},
+		&testVector{"{{ {} | json }}", `{}`},
+		&testVector{"{{{a: 1, 2: [3], \"c d\": {'e': 'f'}}|json}}", `{"2":[3],"a":1,"c d":{"e":"f"}}`},
+		&testVector{"{{{'a': {'b': 1}}}}", "map[a:map[b:1]]"},
+		&testVector{"{{ {'a': 1 ? 2 : 3}.a }}", "2"},
+		&testVector{"{{ {'k': \"x{{var}}\"}.k }}", "xworld"},
+		&testVector{"{{ {'k': 'v'}['k'] }}", "v"},
+		&testVector{"{{ {} == {} }} {{ {'a':[1]} == {'a':[1]} }} {{ {'a': 1} != {'a': 1} }}", "1 1 0"},
+		&testVector{"{{ {'a': 1} == {'a': 2} }} {{ {'a': 1} == {'b': 1} }} {{ {'a': 1} == {} }} {{ {} == [] }}", "0 0 0 0"},
+		&testVector{"{{ prices == {'USD': 12, 'EUR': 10} }}", "1"},
 		// filter tests
 		&testVector{"hello {{var|upper}}", "hello WORLD"},
 		&testVector{"hello {{var|upper|lower}}", "hello world"},
 		&testVector{"hello {{var2.foo|upper}}", "hello BAR"},
 		&testVector{"{{var2|json}}", `{"foo":"bar","num":40}`},
+		// filter arguments
+		&testVector{"{{var|truncate(3)}}", "wor"},
+		&testVector{"{{var|truncate(1 + 1)|upper}}", "WO"},
+		&testVector{"{{var | truncate ( var2.num / 10 )}}", "worl"},
+		&testVector{"{{var|truncate(20)}}", "world"},
+		&testVector{"{{var|upper()}}", "WORLD"},
+		&testVector{"{{concat('x', var|truncate(2))}}", "xwo"},
+		&testVector{"{{var2.num | 2}}", "42"},
+		&testVector{"{{var2.num | (var2.num + 2)}}", "42"},
+		&testVector{"{{var2.num | -1}}", "-1"},
+		// conditional blocks
+		&testVector{"a{{if var}}b{{end}}c", "abc"},
+		&testVector{"a{{if missing}}b{{end}}c", "ac"},
+		&testVector{"{{if missing}}a{{else}}b{{end}}", "b"},
+		&testVector{"{{if var2.num > 50}}a{{else if var2.num > 30}}b{{else}}c{{end}}", "b"},
+		&testVector{"{{if 0}}a{{else if 0}}b{{else}}c{{end}}", "c"},
+		&testVector{"{{if 0}}a{{else if 0}}b{{end}}", ""},
+		&testVector{"{{ if var == 'world' }}hello {{var}}{{ end }}!", "hello world!"},
+		&testVector{"{{if var}}{{if missing}}a{{else}}b{{end}}{{end}}", "b"},
+		&testVector{"{{if(var)}}a{{end}}", "a"},
+		&testVector{"{{if missing}}{{missing.foo.bar}}{{end}}", ""},
+		&testVector{"{{if var}}{{raw}}{{end}}{{endraw}}{{end}}", "{{end}}"},
+		&testVector{"<ul>\n  {{- if var -}}\n  <li>\n  {{- else -}}\n  none\n  {{- end -}}\n</ul>", "<ul><li></ul>"},
+		&testVector{"{{ concat('[', \"{{if var}}x{{end}}\", ']') }}", "[x]"},
+		&testVector{"{{end_date ?? 'none'}} {{ifx ?? 'x'}}", "none x"},
+		// loop blocks
+		&testVector{"{{for n in nums}}{{n}},{{end}}", "10,20,30,"},
+		&testVector{"{{for item in items}}<{{item.name}}>{{end}}", "<first><second>"},
+		&testVector{"{{for i, n in nums}}{{i}}={{n}} {{end}}", "0=10 1=20 2=30 "},
+		&testVector{"{{for k, v in prices}}{{k}}:{{v}};{{end}}", "EUR:10;USD:12;"},
+		&testVector{"{{for k in prices}}{{k}} {{end}}", "EUR USD "},
+		&testVector{"{{for k, v in {'b': 2, 'a': 1, 'c': 3} }}{{k}}{{v}}{{end}}", "a1b2c3"},
+		&testVector{"{{for code, text in codes}}{{code}} {{text}}{{end}}", "404 Not Found"},
+		&testVector{"{{for n in nums}}{{loop.index}}/{{loop.length}}{{if !loop.last}}, {{end}}{{end}}", "1/3, 2/3, 3/3"},
+		&testVector{"{{for n in nums}}{{loop.index0}}{{loop.first}}{{loop.last}} {{end}}", "010 100 201 "},
+		&testVector{"{{for n in missing}}x{{else}}empty{{end}}", "empty"},
+		&testVector{"{{for n in []}}x{{else}}empty{{end}}", "empty"},
+		&testVector{"{{for n in nums}}x{{else}}empty{{end}}", "xxx"},
+		&testVector{"{{for n in []}}x{{end}}", ""},
+		&testVector{"{{for a in [1, 2]}}{{for b in ['x', 'y']}}{{a}}{{b}}{{loop.parent.index}}{{loop.index}} {{end}}{{end}}", "1x11 1y12 2x21 2y22 "},
+		&testVector{"{{for var in [1, 2]}}{{var}}{{end}} {{var}}", "12 world"},
+		&testVector{"{{for i in range(-2)}}{{i}}{{end}}|{{for i in range(0, 10, 4)}}{{i}}{{end}}|{{for i in range(0, 10, -1)}}{{i}}{{end}}", "|048|"},
+		&testVector{"{{range(100000)[99999]}}", "99999"},
+		&testVector{"{{for i in range(3)}}{{i}}{{end}} {{for i in range(2, 5)}}{{i}}{{end}} {{for i in range(5, 0, -2)}}{{i}}{{end}}", "012 234 531"},
+		&testVector{"<ul>\n{{- for n in nums }}\n  <li>{{n}}</li>\n{{- end }}\n</ul>", "<ul>\n  <li>10</li>\n  <li>20</li>\n  <li>30</li>\n</ul>"},
+		&testVector{"{{for n in(nums)}}{{if n > 15}}{{n}}{{end}}{{end}}", "2030"},
+		&testVector{"{{for x in [null, 1]}}[{{x}}]{{end}}", "[][1]"},
+		&testVector{"{{format ?? 'none'}}", "none"},
+		// local bindings
+		&testVector{"{{set total = var2.num * 2}}{{total}} {{total + 1}}", "80 81"},
+		&testVector{"a {{- set x = 1 -}} b{{x}}", "ab1"},
+		&testVector{"{{set var = 'shadowed'}}{{var}}", "shadowed"},
+		&testVector{"{{set x = 1}}{{set x = x + 1}}{{x}}", "2"},
+		&testVector{"{{set n = nums[0]}}{{for x in nums}}{{set n = n + x}}{{n}} {{end}}{{n}}", "20 30 40 10"},
+		&testVector{"{{if var}}{{set x = 'in'}}{{x}}{{else}}{{set x = 'out'}}{{x}}{{end}}{{x ?? '-'}}", "in-"},
+		&testVector{"{{set total = 0}}{{if total == 0}}zero{{end}}", "zero"},
+		&testVector{"{{set first = items[0]}}{{first.name}}", "first"},
+		&testVector{"{{settings ?? 'none'}}", "none"},
 	}
 
 	for _, vect := range testV {
@@ -74,3 +325,403 @@ func TestParser(t *testing.T) {
 		}
 	}
 }
+
+func TestParseErrors(t *testing.T) {
+	testV := []string{
+		"{{(1 + 2}}",
+		"{{1 + 2)}}",
+		"{{()}}",
+		"{{((1)}}",
+		"{{(1))}}",
+		"{{1 +}}",
+		"{{1 * / 2}}",
+		"{{-}}",
+		"{{1 2}}",
+		"{{1 ? 2}}",
+		"{{1 : 2}}",
+		"{{1 ? 2 : }}",
+		"{{? 1 : 2}}",
+		"{{1 ??}}",
+		"{{items[}}",
+		"{{items[]}}",
+		"{{items]}}",
+		"{{.foo}}",
+		"{{var2.}}",
+		"{{var2.[0]}}",
+		"{{nosuchfunc(1)}}",
+		"{{max(1,)}}",
+		"{{max(,1)}}",
+		"{{max(1}}",
+		"{{max(1 2)}}",
+		"{{1, 2}}",
+		"{{08}}",
+		"{{1__0}}",
+		"{{1_}}",
+		"{{0b102}}",
+		"{{0x}}",
+		"{{5abc}}",
+		"{{1.2.3}}",
+		"{{\"\\q\"}}",
+		"{{\"\\x1\"}}",
+		"{{\"\\xZZ\"}}",
+		"{{\"\\u12\"}}",
+		"{{\"\\UFFFFFFFF\"}}",
+		"{{\"\\uD800\"}}",
+		"{{\"\\400\"}}",
+		"{{\"\\",
+		"{{raw}}unterminated {{end}}",
+		"{{raw}}unterminated {{endraw",
+		"{{/* unterminated }}",
+		"{{/* not closed */",
+		"{{/* comment */ var}}",
+		"{{ var-}}",
+		"{{1 not 2}}",
+		"{{1 foo 2}}",
+		"{{1 in}}",
+		"{{var =~ '('}}",
+		"{{var =~ null}}",
+		"{{var !~ '[a-'}}",
+		"{{var|truncate(}}",
+		"{{var|truncate(1,)}}",
+		"{{var|nosuchfilter}}",
+		"{{var2.num | var2}}",
+		"{{var|}}",
+		"{{[1, 2}}",
+		"{{[1,, 2]}}",
+		"{{[,]}}",
+		"{{ {'a' 1} }}",
+		"{{ {'a': } }}",
+		"{{ {'a': 1,} }}",
+		"{{ {'a': 1 }}",
+		"{{ {[1]: 2} }}",
+		"{{ 1 } }}",
+		"{{if var}}unterminated",
+		"{{if var}}a{{else}}b",
+		"{{if var}}a{{else}}b{{else}}c{{end}}",
+		"{{if var}}a{{else}}b{{else if var}}c{{end}}",
+		"{{if var}}{{if var}}a{{end}}",
+		"a{{end}}",
+		"a{{else}}b",
+		"a{{else if var}}b{{end}}",
+		"{{if}}a{{end}}",
+		"{{if var}}a{{else if}}b{{end}}",
+		"{{if var +}}a{{end}}",
+		"{{ concat(\"{{if var}}x\") }}{{end}}",
+		"{{for n in nums}}unterminated",
+		"{{for n in nums}}a{{else}}b",
+		"{{for n in nums}}a{{else if n}}b{{end}}",
+		"{{for n in nums}}a{{else}}b{{else}}c{{end}}",
+		"{{for n nums}}a{{end}}",
+		"{{for n in}}a{{end}}",
+		"{{for 1 in nums}}a{{end}}",
+		"{{for true in nums}}a{{end}}",
+		"{{for k, in nums}}a{{end}}",
+		"{{if var}}{{for n in nums}}a{{end}}",
+		"{{for n in nums}}{{if n}}a{{end}}",
+		"{{for n in nums}}{{n +}}{{end}}",
+		"{{set x}}",
+		"{{set x 1}}",
+		"{{set x =}}",
+		"{{set x == 1}}",
+		"{{set 1 = 2}}",
+		"{{set null = 2}}",
+		"{{set x = 1 +}}",
+		"{{if var}}{{set x = 1}}a",
+		"{{set x = 1}}{{end}}",
+	}
+
+	for _, in := range testV {
+		if _, err := replvar.ParseString(in, "text"); err == nil {
+			t.Errorf("expected error parsing %s", in)
+		}
+	}
+
+	if _, err := replvar.ParseVariable("(1 + 2"); err == nil {
+		t.Errorf("expected error parsing unbalanced expression")
+	}
+
+	missing := map[string]string{
+		"{{(1 + 2}}":          "missing )",
+		"{{((1) + 2}}":        "missing )",
+		"{{ 2 * (1 + 2}}":     "missing )",
+		"{{items[0}}":         "missing ]",
+		"{{items[(0]}}":       "missing )",
+		"{{max(1, (2}}":       "missing )",
+		"{{ concat('a', 1 }}": "missing )",
+		"{{[1, 2}}":           "missing ]",
+		"{{ {'a': (1} }}":     "missing )",
+		"{{ (1]) }}":          "missing )",
+	}
+	for in, msg := range missing {
+		_, err := replvar.ParseString(in, "text")
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected error containing %q parsing %s, got %v", msg, in, err)
+		}
+	}
+}
+
+func TestCoalesceTypedNil(t *testing.T) {
+	var m map[string]any
+	var p *int
+	ctx := context.WithValue(context.Background(), "m", m)
+	ctx = context.WithValue(ctx, "p", p)
+
+	res, err := replvar.Replace(ctx, "{{m ?? 'dflt'}} {{p ?? 'dflt'}}", "text")
+	if err != nil {
+		t.Fatalf("failed to run: %s", err)
+	}
+	if res != "dflt dflt" {
+		t.Errorf("invalid result for typed nil coalescing: %s", res)
+	}
+}
+
+func TestFunctionStatic(t *testing.T) {
+	replvar.RegisterFunction("test_counter", func(ctx context.Context, args []any) (any, error) {
+		return len(args), nil
+	})
+
+	testV := map[string]bool{
+		"max(1, 2)":                        true,
+		"concat('a', max(1))":              true,
+		"max(1, var)":                      false,
+		"test_counter()":                   false,
+		"test_counter(1, 2)":               false,
+		"max(test_counter())":              false,
+		"[1, 'a', [2]]":                    true,
+		"[1, var]":                         false,
+		"{'a': 1, b: [2]}":                 true,
+		"{'a': var}":                       false,
+		"{\"{{var}}\": 1}":                 false,
+		"\"{{if 1}}a{{else}}b{{end}}\"":    true,
+		"\"{{if var}}a{{end}}\"":           false,
+		"\"{{if 1}}{{var}}{{end}}\"":       false,
+		"\"{{for n in [1]}}a{{end}}\"":     true,
+		"\"{{for n in [1]}}{{n}}{{end}}\"": false,
+		"\"{{set x = 1}}a\"":               true,
+		"\"{{set x = 1}}{{x}}\"":           false,
+		"\"{{set x = var}}a\"":             false,
+		"range(3)":                         true,
+	}
+
+	for in, static := range testV {
+		v, err := replvar.ParseVariable(in)
+		if err != nil {
+			t.Errorf("failed to parse %s: %s", in, err)
+			continue
+		}
+		if v.IsStatic() != static {
+			t.Errorf("invalid IsStatic for %s: got %v but expected %v", in, v.IsStatic(), static)
+		}
+	}
+
+	res, err := replvar.Replace(context.Background(), "{{test_counter(1, 2, 3)}}", "text")
+	if err != nil || res != "3" {
+		t.Errorf("invalid result for test_counter: %s (err=%v)", res, err)
+	}
+}
+
+func TestDelimiters(t *testing.T) {
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, "var", "world")
+	ctx = context.WithValue(ctx, "items", []any{map[string]any{"name": "first"}})
+
+	testV := []struct {
+		open, close string
+		in, out     string
+	}{
+		{"${", "}", "hello ${var}, {{var}} {{{x}}}", "hello world, {{var}} {{{x}}}"},
+		{"${", "}", "${ {'a': 1}.a + 1 }", "2"},
+		{"<%", "%>", "<% 10 % 4 %> <%var%>", "2 world"},
+		{"[[", "]]", "[[ items[0].name ]] [[[1, 2][1]]]", "first 2"},
+		{"[[", "]]", "[[ \"x[[var]]\" ]] [[var|upper]]", "xworld WORLD"},
+		{"<<", ">>", "<< 1 << 2 >>", "4"},
+	}
+
+	for _, vect := range testV {
+		res, err := replvar.Replace(ctx, vect.in, "text", replvar.WithDelimiters(vect.open, vect.close))
+		if err != nil {
+			t.Errorf("failed to run %s: %s", vect.in, err)
+			continue
+		}
+		if res != vect.out {
+			t.Errorf("invalid result for %s: got %s but expected %s", vect.in, res, vect.out)
+		}
+	}
+
+	if _, err := replvar.ParseString("x", "text", replvar.WithDelimiters("", "}")); err == nil {
+		t.Errorf("expected error with empty delimiter")
+	}
+	if _, err := replvar.ParseString("${var", "text", replvar.WithDelimiters("${", "}")); err == nil {
+		t.Errorf("expected error with unterminated variable")
+	}
+}
+
+func TestKeywordNil(t *testing.T) {
+	var m map[string]any
+	var p *int
+	ctx := context.WithValue(context.Background(), "m", m)
+	ctx = context.WithValue(ctx, "p", p)
+
+	res, err := replvar.Replace(ctx, "{{m == null}} {{p == nil}} {{m != null}}", "text")
+	if err != nil {
+		t.Fatalf("failed to run: %s", err)
+	}
+	if res != "1 1 0" {
+		t.Errorf("invalid result for typed nil comparison: %s", res)
+	}
+}
+
+func TestRegexpDynamicError(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "pattern", "(")
+	if _, err := replvar.Replace(ctx, "{{'x' =~ pattern}}", "text"); err == nil {
+		t.Errorf("expected error for invalid dynamic pattern")
+	}
+	if _, err := replvar.Replace(ctx, "{{'<nil>' =~ missing}}", "text"); err == nil {
+		t.Errorf("expected error for null dynamic pattern")
+	}
+}
+
+func TestShortCircuitError(t *testing.T) {
+	ctx := context.Background()
+	for _, in := range []string{"{{1 && missing.name}}", "{{0 || missing.name}}"} {
+		if _, err := replvar.Replace(ctx, in, "text"); err == nil {
+			t.Errorf("expected error from right operand for %s", in)
+		}
+	}
+}
+
+func TestOptionalChainError(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "var2", map[string]any{"foo": "bar"})
+	// ?. only short-circuits when its own object is missing
+	for _, in := range []string{"{{var2?.missing.field}}", "{{var2?.foo.field}}", "{{missing.field?.deeper}}"} {
+		if _, err := replvar.Replace(ctx, in, "text"); err == nil {
+			t.Errorf("expected error running %s", in)
+		}
+	}
+}
+
+func TestValueLogic(t *testing.T) {
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, "title", "Hello")
+	ctx = context.WithValue(ctx, "empty", "")
+	ctx = context.WithValue(ctx, "user", map[string]any{"name": "Alice"})
+
+	testV := []*testVector{
+		&testVector{"{{title || 'Untitled'}}", "Hello"},
+		&testVector{"{{empty || 'Untitled'}}", "Untitled"},
+		&testVector{"{{missing || empty || 'Untitled'}}", "Untitled"},
+		&testVector{"{{missing || empty}}", ""},
+		&testVector{"{{user && user.name}}", "Alice"},
+		&testVector{"{{missing && missing.name}}", ""},
+		&testVector{"{{empty && 'x'}}|{{0 && 'x'}}", "|0"},
+		&testVector{"{{(user && user.name) || 'Guest'}}", "Alice"},
+		&testVector{"{{!title || 'x'}}", "x"},
+		&testVector{"{{1 == 1 && 'yes'}}", "yes"},
+	}
+
+	for _, vect := range testV {
+		res, err := replvar.Replace(ctx, vect.in, "text", replvar.WithValueLogic())
+		if err != nil {
+			t.Errorf("failed to run %s: %s", vect.in, err)
+			continue
+		}
+		if res != vect.out {
+			t.Errorf("invalid result for %s: got %s but expected %s", vect.in, res, vect.out)
+		}
+	}
+
+	// without the option, logical operators return a bool
+	res, err := replvar.Replace(ctx, "{{title || 'Untitled'}}", "text")
+	if err != nil || res != "1" {
+		t.Errorf("invalid result without WithValueLogic: %s (err=%v)", res, err)
+	}
+}
+
+func TestLoopMapOrder(t *testing.T) {
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, "u", map[uint64]string{3: "c", 18446744073709551615: "z", 1: "a", 2: "b", 9223372036854775808: "y"})
+	ctx = context.WithValue(ctx, "f", map[float64]int{2.5: 1, -1: 2, 10: 3})
+	ctx = context.WithValue(ctx, "b", map[bool]int{true: 1, false: 0})
+	ctx = context.WithValue(ctx, "m", map[any]int{"b": 1, 2: 2, "a": 3, 1: 4, true: 5})
+
+	testV := []*testVector{
+		&testVector{"{{for v in u}}{{v}}{{end}}", "123922337203685477580818446744073709551615"},
+		&testVector{"{{for k, v in u}}{{v}}{{end}}", "abcyz"},
+		&testVector{"{{for k in f}}{{k}} {{end}}", "-1 2.5 10 "},
+		&testVector{"{{for k, v in b}}{{v}}{{end}}", "01"},
+		&testVector{"{{for k, v in m}}{{v}}{{end}}", "54231"},
+	}
+
+	for i := 0; i < 20; i++ {
+		for _, vect := range testV {
+			res, err := replvar.Replace(ctx, vect.in, "text")
+			if err != nil {
+				t.Fatalf("failed to run %s: %s", vect.in, err)
+			}
+			if res != vect.out {
+				t.Fatalf("invalid result for %s: got %s but expected %s", vect.in, res, vect.out)
+			}
+		}
+	}
+}
+
+func TestLoopParent(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "loop", map[string]any{"index": 7})
+
+	testV := []*testVector{
+		&testVector{"{{loop.index}}", "7"},
+		&testVector{"{{for x in [1]}}{{loop.parent ?? 'none'}}{{end}}", "none"},
+		&testVector{"{{for x in [1]}}[{{loop.parent?.index}}]{{end}}", "[]"},
+		&testVector{"{{for a in [1, 2]}}{{for b in [1]}}{{loop.parent.index}}{{end}}{{end}} {{loop.index}}", "12 7"},
+	}
+
+	for _, vect := range testV {
+		res, err := replvar.Replace(ctx, vect.in, "text")
+		if err != nil {
+			t.Fatalf("failed to run %s: %s", vect.in, err)
+		}
+		if res != vect.out {
+			t.Errorf("invalid result for %s: got %s but expected %s", vect.in, res, vect.out)
+		}
+	}
+}
+
+func TestLoopErrors(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "var", "world")
+
+	for _, in := range []string{"{{for c in var}}{{c}}{{end}}", "{{for i in range(0, 5, 0)}}{{i}}{{end}}", "{{for i in range()}}{{end}}", "{{for i in range(1e12)}}{{end}}", "{{range(-9223372036854775808, 9223372036854775807)}}", "{{range(0, -100001, -1)}}"} {
+		if _, err := replvar.Replace(ctx, in, "text"); err == nil {
+			t.Errorf("expected error running %s", in)
+		}
+	}
+}
+
+func TestSetContext(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "var", "world")
+
+	v, err := replvar.ParseString("{{set var = 'local'}}{{var}}", "text")
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		res, err := v.Resolve(ctx)
+		if err != nil || res != "local" {
+			t.Errorf("invalid result: %v (err=%v)", res, err)
+		}
+	}
+	if ctx.Value("var") != "world" {
+		t.Errorf("set modified the caller's context")
+	}
+}
+
+func TestCommentStatic(t *testing.T) {
+	for _, in := range []string{"a {{/* comment */}}b", "a\n  {{- /* comment */ -}}\n  b"} {
+		v, err := replvar.ParseString(in, "text")
+		if err != nil {
+			t.Fatalf("failed to parse: %s", err)
+		}
+		if !v.IsStatic() {
+			t.Errorf("expected static result for %s", in)
+		}
+	}
+}
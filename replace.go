@@ -2,13 +2,11 @@ package replvar
 
 import (
 	"context"
-
-	"github.com/KarpelesLab/typutil"
 )
 
 // Replace will replace any variable found in s with their value from the context
-func Replace(ctx context.Context, s string, mode string) (string, error) {
-	obj, err := ParseString(s, mode)
+func Replace(ctx context.Context, s string, mode string, opts ...ParseOption) (string, error) {
+	obj, err := ParseString(s, mode, opts...)
 	if err != nil {
 		return "", err
 	}
@@ -17,6 +15,5 @@ func Replace(ctx context.Context, s string, mode string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	strres, _ := typutil.AsString(res)
-	return strres, nil
+	return asString(res), nil
 }
@@ -2,17 +2,13 @@ package replvar
 
 import (
 	"context"
-
-	"github.com/KarpelesLab/typutil"
 )
 
 // ResolveString returns the string value for a variable name based on the context
 //
 // Deprecated: use ParseVariable and resolve instead
 func ResolveString(ctx context.Context, v string) string {
-	res := Resolve(ctx, v)
-	strres, _ := typutil.AsString(res)
-	return strres
+	return asString(Resolve(ctx, v))
 }
 
 // Resolve returns the value for a variable name based on the context
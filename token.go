@@ -10,7 +10,7 @@ const (
 	TokenVariable                    // Identifier/variable name (e.g., "foo", "myVar")
 	TokenNumber                      // Numeric literal (integer or float)
 	TokenStringConstant              // String literal delimiter (", ', or `)
-	TokenVariableEnd                 // End of variable expression: }}
+	TokenVariableEnd                 // End of variable expression: }} or custom delimiter
 
 	// Operators
 	TokenDot          // Member access: .
@@ -34,8 +34,76 @@ const (
 	TokenXor          // Bitwise XOR: ^
 	TokenShiftLeft    // Left shift: <<
 	TokenShiftRight   // Right shift: >>
+
+	// Grouping
+	TokenParenOpen  // Opening parenthesis: (
+	TokenParenClose // Closing parenthesis: )
+
+	// Conditional
+	TokenQuestion // Conditional operator: ?
+	TokenColon    // Conditional branch separator: :
+	TokenCoalesce // Null-coalescing: ??
+
+	TokenOptionalDot // Optional member access: ?.
+
+	TokenBracketOpen  // Opening bracket: [
+	TokenBracketClose // Closing bracket: ]
+	TokenComma        // List separator: ,
+
+	TokenBraceOpen  // Opening brace: {
+	TokenBraceClose // Closing brace: }
+
+	TokenIn    // Membership: in
+	TokenNotIn // Negated membership: not in
+
+	TokenMatch    // Regular expression match: =~
+	TokenNotMatch // Negated regular expression match: !~
 )
 
+// tokenNames holds the textual representation of tokens, used in error messages.
+var tokenNames = map[Token]string{
+	TokenVariable:       "variable",
+	TokenNumber:         "number",
+	TokenStringConstant: "string",
+	TokenVariableEnd:    "end of variable",
+	TokenDot:            ".",
+	TokenAdd:            "+",
+	TokenSubtract:       "-",
+	TokenMultiply:       "*",
+	TokenDivide:         "/",
+	TokenModulo:         "%",
+	TokenEqual:          "==",
+	TokenDifferent:      "!=",
+	TokenLess:           "<",
+	TokenLessEqual:      "<=",
+	TokenGreater:        ">",
+	TokenGreaterEqual:   ">=",
+	TokenNot:            "!",
+	TokenBitwiseNot:     "~",
+	TokenOr:             "|",
+	TokenLogicOr:        "||",
+	TokenAnd:            "&",
+	TokenLogicAnd:       "&&",
+	TokenXor:            "^",
+	TokenShiftLeft:      "<<",
+	TokenShiftRight:     ">>",
+	TokenParenOpen:      "(",
+	TokenParenClose:     ")",
+	TokenQuestion:       "?",
+	TokenColon:          ":",
+	TokenCoalesce:       "??",
+	TokenOptionalDot:    "?.",
+	TokenBracketOpen:    "[",
+	TokenBracketClose:   "]",
+	TokenComma:          ",",
+	TokenBraceOpen:      "{",
+	TokenBraceClose:     "}",
+	TokenIn:             "in",
+	TokenNotIn:          "not in",
+	TokenMatch:          "=~",
+	TokenNotMatch:       "!~",
+}
+
 // operatorPrecedence defines the precedence of operators.
 // Lower values bind tighter (higher precedence).
 // Based on https://en.wikipedia.org/wiki/Order_of_operations
@@ -53,13 +121,20 @@ var operatorPrecedence = map[Token]int{
 	TokenLessEqual:    6,
 	TokenGreater:      6,
 	TokenGreaterEqual: 6,
+	TokenIn:           6,
+	TokenNotIn:        6,
 	TokenEqual:        7,
 	TokenDifferent:    7,
+	TokenMatch:        7,
+	TokenNotMatch:     7,
 	TokenAnd:          8,
 	TokenXor:          9,
 	TokenOr:           10,
 	TokenLogicAnd:     11,
 	TokenLogicOr:      12,
+	TokenCoalesce:     13,
+	TokenQuestion:     14,
+	TokenColon:        14,
 }
 
 // readToken reads the next token from the parser buffer.
@@ -67,6 +142,9 @@ var operatorPrecedence = map[Token]int{
 // that make up a number or variable name). Whitespace is automatically skipped.
 func (p *parser) readToken() (Token, []rune) {
 	for {
+		if p.depth == 0 && p.readClose() {
+			return TokenVariableEnd, p.close
+		}
 		switch p.cur() {
 		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 			return TokenNumber, p.readNumberToken()
@@ -93,6 +171,35 @@ func (p *parser) readToken() (Token, []rune) {
 		case '^':
 			p.forward()
 			return TokenXor, nil
+		case '?':
+			if p.next() == '?' {
+				p.forward2()
+				return TokenCoalesce, nil
+			}
+			if p.next() == '.' {
+				p.forward2()
+				return TokenOptionalDot, nil
+			}
+			p.forward()
+			return TokenQuestion, nil
+		case ':':
+			p.forward()
+			return TokenColon, nil
+		case '[':
+			p.forward()
+			return TokenBracketOpen, nil
+		case ']':
+			p.forward()
+			return TokenBracketClose, nil
+		case ',':
+			p.forward()
+			return TokenComma, nil
+		case '(':
+			p.forward()
+			return TokenParenOpen, nil
+		case ')':
+			p.forward()
+			return TokenParenClose, nil
 		case '~':
 			p.forward()
 			return TokenBitwiseNot, nil
@@ -123,12 +230,20 @@ func (p *parser) readToken() (Token, []rune) {
 				p.forward2()
 				return TokenEqual, nil
 			}
+			if p.next() == '~' {
+				p.forward2()
+				return TokenMatch, nil
+			}
 			return TokenInvalid, []rune{p.cur()}
 		case '!':
 			if p.next() == '=' {
 				p.forward2()
 				return TokenDifferent, nil
 			}
+			if p.next() == '~' {
+				p.forward2()
+				return TokenNotMatch, nil
+			}
 			p.forward()
 			return TokenNot, nil
 		case '|':
@@ -145,11 +260,12 @@ func (p *parser) readToken() (Token, []rune) {
 			}
 			p.forward()
 			return TokenAnd, nil
+		case '{':
+			p.forward()
+			return TokenBraceOpen, nil
 		case '}':
-			if p.next() == '}' {
-				return TokenVariableEnd, []rune{p.take(), p.take()}
-			}
-			return TokenInvalid, []rune{p.cur()}
+			p.forward()
+			return TokenBraceClose, nil
 		case ' ', '\t', '\r', '\n':
 			// skip spaces
 			p.forward()
@@ -163,25 +279,39 @@ func (p *parser) readToken() (Token, []rune) {
 	}
 }
 
-// readNumberToken reads a numeric literal (integer or floating-point).
-// It supports decimal numbers with an optional single decimal point.
+// readNumberToken reads a numeric literal. It accepts Go-style literals:
+// decimal, hexadecimal (0x), octal (0o or leading 0) and binary (0b)
+// integers, decimal and hexadecimal floating-point numbers with exponents,
+// and _ digit separators. The literal is only validated by parseNumber.
 func (p *parser) readNumberToken() []rune {
 	var res []rune
 	hasDot := false
+	hex := p.cur() == '0' && (p.next() == 'x' || p.next() == 'X')
 
 	for {
 		c := p.cur()
-		switch c {
-		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		switch {
+		case (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_':
 			res = append(res, c)
 			p.forward()
-		case '.':
+		case c == '.':
 			if hasDot {
 				return res
 			}
 			res = append(res, c)
 			hasDot = true
 			p.forward()
+		case c == '+' || c == '-':
+			// sign of an exponent (e for decimal, p for hexadecimal)
+			last := res[len(res)-1]
+			if hex && last != 'p' && last != 'P' {
+				return res
+			}
+			if !hex && last != 'e' && last != 'E' {
+				return res
+			}
+			res = append(res, c)
+			p.forward()
 		default:
 			return res
 		}
@@ -249,6 +379,14 @@ func (t Token) MathOp() string {
 	}
 }
 
+// String returns the textual representation of the token.
+func (t Token) String() string {
+	if s, ok := tokenNames[t]; ok {
+		return s
+	}
+	return "invalid"
+}
+
 // Precedence returns the operator precedence for this token.
 // Lower values bind tighter (higher precedence).
 // Returns 0 for non-operator tokens.
@@ -5,6 +5,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/KarpelesLab/pjson"
 	"github.com/KarpelesLab/typutil"
@@ -44,8 +50,7 @@ func (a varConcat) Resolve(ctx context.Context) (any, error) {
 		if err != nil {
 			return nil, err
 		}
-		str, _ := typutil.AsString(v)
-		res.WriteString(str)
+		res.WriteString(asString(v))
 	}
 	return res.String(), nil
 }
@@ -59,6 +64,63 @@ func (a varConcat) IsStatic() bool {
 	return true
 }
 
+// varArray builds a []any from a list of Var values.
+// Implements array literals like [a, b, c].
+type varArray []Var
+
+func (a varArray) Resolve(ctx context.Context) (any, error) {
+	res := make([]any, 0, len(a))
+	for _, sub := range a {
+		v, err := sub.Resolve(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+func (a varArray) IsStatic() bool {
+	for _, sub := range a {
+		if !sub.IsStatic() {
+			return false
+		}
+	}
+	return true
+}
+
+// varObject builds a map[string]any from lists of keys and values.
+// Implements object literals like {'key': value}.
+type varObject struct {
+	keys, values []Var
+}
+
+func (o *varObject) Resolve(ctx context.Context) (any, error) {
+	res := make(map[string]any, len(o.keys))
+	for i, k := range o.keys {
+		key, err := k.Resolve(ctx)
+		if err != nil {
+			return nil, err
+		}
+		v, err := o.values[i].Resolve(ctx)
+		if err != nil {
+			return nil, err
+		}
+		str, _ := typutil.AsString(key)
+		res[str] = v
+	}
+	return res, nil
+}
+
+func (o *varObject) IsStatic() bool {
+	for i, k := range o.keys {
+		if !k.IsStatic() || !o.values[i].IsStatic() {
+			return false
+		}
+	}
+	return true
+}
+
 // varFetchFromCtx retrieves a value from the context by key name.
 // This is used for variable references like {{myvar}}.
 type varFetchFromCtx string
@@ -141,26 +203,88 @@ func (n *varBitwiseNot) IsStatic() bool {
 	return n.sub.IsStatic()
 }
 
+// varNegate performs arithmetic negation on its sub-expression.
+// Implements the unary - operator.
+type varNegate struct {
+	sub Var
+}
+
+func (n *varNegate) Resolve(ctx context.Context) (any, error) {
+	sub, err := n.sub.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if num, ok := typutil.AsNumber(sub); ok {
+		switch v := num.(type) {
+		case int64:
+			return -v, nil
+		case uint64:
+			if v <= math.MaxInt64+1 {
+				return -int64(v), nil
+			}
+			// too large to negate as an integer
+			return -float64(v), nil
+		case float64:
+			return -v, nil
+		}
+	}
+	return nil, fmt.Errorf("negation requires numeric operand, got %T", sub)
+}
+
+func (n *varNegate) IsStatic() bool {
+	return n.sub.IsStatic()
+}
+
+// chainVar is implemented by member and index access nodes. An optional
+// access that yields nil because its object is nil or cannot be accessed
+// short-circuits the rest of the chain, so that a?.b.c yields nil when a is
+// nil instead of failing on .c.
+type chainVar interface {
+	// resolveChain resolves the access, and returns true if an optional
+	// access in the chain short-circuited it.
+	resolveChain(ctx context.Context) (any, bool, error)
+}
+
+// resolveChainSub resolves the object of an access, which may itself be part
+// of a chain.
+func resolveChainSub(ctx context.Context, sub Var) (any, bool, error) {
+	if c, ok := sub.(chainVar); ok {
+		return c.resolveChain(ctx)
+	}
+	v, err := sub.Resolve(ctx)
+	return v, false, err
+}
+
 // varAccessOffset accesses a field/key of a map or object.
-// Implements the . (dot) operator for member access like obj.field.
+// Implements the . (dot) operator for member access like obj.field, and the
+// ?. operator which yields nil instead of failing when obj cannot be accessed,
+// short-circuiting the rest of the chain.
 type varAccessOffset struct {
-	sub    Var    // the object to access
-	offset string // the field/key name
+	sub      Var    // the object to access
+	offset   string // the field/key name
+	optional bool   // if true, return nil when sub is nil or not indexable
 }
 
 func (a *varAccessOffset) Resolve(ctx context.Context) (any, error) {
-	sub, err := a.sub.Resolve(ctx)
-	if err != nil {
-		return nil, err
+	v, _, err := a.resolveChain(ctx)
+	return v, err
+}
+
+func (a *varAccessOffset) resolveChain(ctx context.Context) (any, bool, error) {
+	sub, short, err := resolveChainSub(ctx, a.sub)
+	if err != nil || short {
+		return nil, short, err
 	}
 	switch elem := sub.(type) {
 	case map[string]any:
-		return elem[a.offset], nil
+		return elem[a.offset], false, nil
 	case map[string]string:
-		return elem[a.offset], nil
+		return elem[a.offset], false, nil
 	default:
-		// ??
-		return nil, fmt.Errorf("lookup failed, offset=%s cur type=%T", a.offset, elem)
+		if a.optional {
+			return nil, true, nil
+		}
+		return nil, false, fmt.Errorf("lookup failed, offset=%s cur type=%T", a.offset, elem)
 	}
 }
 
@@ -168,8 +292,153 @@ func (a *varAccessOffset) IsStatic() bool {
 	return a.sub.IsStatic()
 }
 
-// varMath performs binary operations (arithmetic, logical, comparison).
-// Supports: +, -, *, /, %, |, &, ^, ||, &&, ==, !=, <, <=, >, >=, <<, >>
+// varIndex accesses an element of a slice, array or map using a key computed
+// from an expression. Implements the [] operator like obj[key], and ?.[] which
+// yields nil instead of failing when obj cannot be indexed, short-circuiting
+// the rest of the chain. Negative indices
+// count from the end of slices and arrays, and out of range indices yield nil.
+type varIndex struct {
+	sub      Var  // the object to access
+	key      Var  // the index or key
+	optional bool // if true, return nil when sub is nil or not indexable
+}
+
+func (a *varIndex) Resolve(ctx context.Context) (any, error) {
+	v, _, err := a.resolveChain(ctx)
+	return v, err
+}
+
+func (a *varIndex) resolveChain(ctx context.Context) (any, bool, error) {
+	sub, short, err := resolveChainSub(ctx, a.sub)
+	if err != nil || short {
+		return nil, short, err
+	}
+	if a.optional && sub == nil {
+		// the key is not evaluated
+		return nil, true, nil
+	}
+	key, err := a.key.Resolve(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch elem := sub.(type) {
+	case map[string]any:
+		if k, ok := keyString(key); ok {
+			return elem[k], false, nil
+		}
+		return nil, false, nil
+	case map[string]string:
+		if k, ok := keyString(key); ok {
+			return elem[k], false, nil
+		}
+		return nil, false, nil
+	case []any:
+		if i, ok := sliceIndex(key, len(elem)); ok {
+			return elem[i], false, nil
+		}
+		return nil, false, nil
+	}
+
+	v := reflect.ValueOf(sub)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		if i, ok := sliceIndex(key, v.Len()); ok {
+			return v.Index(i).Interface(), false, nil
+		}
+		return nil, false, nil
+	case reflect.Map:
+		if key == nil {
+			// a nil key matches no entry
+			return nil, false, nil
+		}
+		k, err := mapKey(key, v.Type().Key())
+		if err != nil {
+			return nil, false, err
+		}
+		if res := v.MapIndex(k); res.IsValid() {
+			return res.Interface(), false, nil
+		}
+		return nil, false, nil
+	}
+
+	if a.optional {
+		return nil, true, nil
+	}
+	return nil, false, fmt.Errorf("index failed, cur type=%T", sub)
+}
+
+func (a *varIndex) IsStatic() bool {
+	return a.sub.IsStatic() && a.key.IsStatic()
+}
+
+// sliceIndex converts key to an index within a sequence of length ln.
+// Negative values count from the end. It returns false if key is not an
+// integer or is out of range.
+func sliceIndex(key any, ln int) (int, bool) {
+	num, ok := typutil.AsNumber(key)
+	if !ok {
+		return 0, false
+	}
+	var i int64
+	switch v := num.(type) {
+	case int64:
+		i = v
+	case uint64:
+		if v > uint64(ln) {
+			return 0, false
+		}
+		i = int64(v)
+	case float64:
+		if v != float64(int64(v)) {
+			return 0, false
+		}
+		i = int64(v)
+	}
+	if i < 0 {
+		i += int64(ln)
+	}
+	if i < 0 || i >= int64(ln) {
+		return 0, false
+	}
+	return int(i), true
+}
+
+// keyString converts key to a string for lookups in string-keyed maps and
+// substring checks. It returns false if key is nil, which matches nothing.
+func keyString(key any) (string, bool) {
+	if key == nil {
+		return "", false
+	}
+	s, _ := typutil.AsString(key)
+	return s, true
+}
+
+// mapKey converts key to a reflect.Value usable as a key of type typ.
+func mapKey(key any, typ reflect.Type) (reflect.Value, error) {
+	if key != nil {
+		k := reflect.ValueOf(key)
+		if k.Type().AssignableTo(typ) {
+			return k, nil
+		}
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		if s, ok := keyString(key); ok {
+			return reflect.ValueOf(s).Convert(typ), nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if num, ok := typutil.AsNumber(key); ok {
+			return reflect.ValueOf(num).Convert(typ), nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("invalid key of type %T for map with %s keys", key, typ)
+}
+
+// varMath performs binary operations (arithmetic, comparison).
+// Supports: +, -, *, /, %, |, &, ^, ==, !=, <, <=, >, >=, <<, >>
 type varMath struct {
 	a, b Var    // left and right operands
 	op   string // the operator ("+", "-", "==", etc.)
@@ -186,14 +455,10 @@ func (m *varMath) Resolve(ctx context.Context) (any, error) {
 	}
 
 	switch m.op {
-	case "&&":
-		return typutil.AsBool(a) && typutil.AsBool(b), nil
-	case "||":
-		return typutil.AsBool(a) || typutil.AsBool(b), nil
 	case "==":
-		return typutil.Equal(a, b), nil
+		return equalValues(a, b), nil
 	case "!=":
-		return !typutil.Equal(a, b), nil
+		return !equalValues(a, b), nil
 	case "<", "<=", ">", ">=":
 		return m.resolveComparison(a, b)
 	case "<<", ">>":
@@ -204,8 +469,94 @@ func (m *varMath) Resolve(ctx context.Context) (any, error) {
 	}
 }
 
+// equalValues compares a and b for equality. A nil value (including nil
+// pointers, maps and slices) is only equal to another nil value, and a bool
+// is equal to any value with the same truthiness. Slices, arrays and maps are
+// compared element by element, and other values with typutil.Equal.
+func equalValues(a, b any) bool {
+	nilA, nilB := isNil(a), isNil(b)
+	if nilA || nilB {
+		return nilA && nilB
+	}
+	if va, ok := a.(bool); ok {
+		return va == typutil.AsBool(b)
+	}
+	if vb, ok := b.(bool); ok {
+		return vb == typutil.AsBool(a)
+	}
+	ra, rb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if isContainer(ra) || isContainer(rb) {
+		// typutil.Equal panics when comparing two slices or maps
+		return equalContainers(ra, rb)
+	}
+	return typutil.Equal(a, b)
+}
+
+// isContainer returns true if v is a slice, array or map, except for byte
+// slices and arrays which typutil.Equal compares as strings.
+func isContainer(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		return v.Type().Elem().Kind() != reflect.Uint8
+	case reflect.Map:
+		return true
+	}
+	return false
+}
+
+// equalContainers returns true if a and b are both slices or arrays with
+// equal elements, or both maps with the same keys and equal values. Elements
+// are compared with equalValues.
+func equalContainers(a, b reflect.Value) bool {
+	if !isContainer(a) || !isContainer(b) || (a.Kind() == reflect.Map) != (b.Kind() == reflect.Map) || a.Len() != b.Len() {
+		return false
+	}
+	if a.Kind() != reflect.Map {
+		for i := 0; i < a.Len(); i++ {
+			if !equalValues(a.Index(i).Interface(), b.Index(i).Interface()) {
+				return false
+			}
+		}
+		return true
+	}
+	kt := b.Type().Key()
+	iter := a.MapRange()
+	for iter.Next() {
+		k := iter.Key()
+		if !k.Type().AssignableTo(kt) {
+			// unwrap keys of map[any]any for lookups in typed maps
+			if k.Kind() != reflect.Interface || k.IsNil() || !k.Elem().Type().AssignableTo(kt) {
+				return false
+			}
+			k = k.Elem()
+		}
+		v := b.MapIndex(k)
+		if !v.IsValid() || !equalValues(iter.Value().Interface(), v.Interface()) {
+			return false
+		}
+	}
+	return true
+}
+
 // resolveComparison handles <, <=, >, >= operators.
 func (m *varMath) resolveComparison(a, b any) (any, error) {
+	cmp := compareValues(a, b)
+	switch m.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	}
+	return false, nil
+}
+
+// compareValues compares a and b, returning -1, 0 or 1. Values are compared
+// numerically if both are numbers, and as strings otherwise.
+func compareValues(a, b any) int {
 	// Try numeric comparison first
 	numA, okA := typutil.AsNumber(a)
 	numB, okB := typutil.AsNumber(b)
@@ -216,6 +567,17 @@ func (m *varMath) resolveComparison(a, b any) (any, error) {
 			switch vb := numB.(type) {
 			case int64:
 				cmp = compareInt64(va, vb)
+			case uint64:
+				cmp = compareInt64Uint64(va, vb)
+			case float64:
+				cmp = compareFloat64(float64(va), vb)
+			}
+		case uint64:
+			switch vb := numB.(type) {
+			case int64:
+				cmp = -compareInt64Uint64(vb, va)
+			case uint64:
+				cmp = compareUint64(va, vb)
 			case float64:
 				cmp = compareFloat64(float64(va), vb)
 			}
@@ -223,35 +585,18 @@ func (m *varMath) resolveComparison(a, b any) (any, error) {
 			switch vb := numB.(type) {
 			case int64:
 				cmp = compareFloat64(va, float64(vb))
+			case uint64:
+				cmp = compareFloat64(va, float64(vb))
 			case float64:
 				cmp = compareFloat64(va, vb)
 			}
 		}
-		switch m.op {
-		case "<":
-			return cmp < 0, nil
-		case "<=":
-			return cmp <= 0, nil
-		case ">":
-			return cmp > 0, nil
-		case ">=":
-			return cmp >= 0, nil
-		}
+		return cmp
 	}
 	// Fall back to string comparison
 	strA, _ := typutil.AsString(a)
 	strB, _ := typutil.AsString(b)
-	switch m.op {
-	case "<":
-		return strA < strB, nil
-	case "<=":
-		return strA <= strB, nil
-	case ">":
-		return strA > strB, nil
-	case ">=":
-		return strA >= strB, nil
-	}
-	return false, nil
+	return strings.Compare(strA, strB)
 }
 
 // resolveShift handles << and >> operators.
@@ -261,13 +606,6 @@ func (m *varMath) resolveShift(a, b any) (any, error) {
 	if !okA || !okB {
 		return nil, fmt.Errorf("shift operators require numeric operands")
 	}
-	var va int64
-	switch v := numA.(type) {
-	case int64:
-		va = v
-	case float64:
-		va = int64(v)
-	}
 	var vb uint64
 	switch v := numB.(type) {
 	case int64:
@@ -277,6 +615,21 @@ func (m *varMath) resolveShift(a, b any) (any, error) {
 	case float64:
 		vb = uint64(v)
 	}
+	var va int64
+	switch v := numA.(type) {
+	case int64:
+		va = v
+	case uint64:
+		// shift unsigned values as such to keep their upper bits
+		switch m.op {
+		case "<<":
+			return v << vb, nil
+		case ">>":
+			return v >> vb, nil
+		}
+	case float64:
+		va = int64(v)
+	}
 	switch m.op {
 	case "<<":
 		return va << vb, nil
@@ -296,6 +649,25 @@ func compareInt64(a, b int64) int {
 	return 0
 }
 
+// compareUint64 compares two uint64 values.
+func compareUint64(a, b uint64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// compareInt64Uint64 compares an int64 with a uint64 without overflow.
+func compareInt64Uint64(a int64, b uint64) int {
+	if a < 0 {
+		return -1
+	}
+	return compareUint64(uint64(a), b)
+}
+
 func compareFloat64(a, b float64) int {
 	if a < b {
 		return -1
@@ -310,6 +682,310 @@ func (m *varMath) IsStatic() bool {
 	return m.a.IsStatic() && m.b.IsStatic()
 }
 
+// varLogic performs logical operations with short-circuit evaluation: the
+// right operand is only resolved (and its errors only reported) when the
+// left operand does not decide the result.
+// Implements the && and || operators.
+type varLogic struct {
+	a, b  Var    // left and right operands
+	op    string // "&&" or "||"
+	value bool   // return the deciding operand instead of a bool
+}
+
+func (l *varLogic) Resolve(ctx context.Context) (any, error) {
+	a, err := l.a.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if typutil.AsBool(a) == (l.op == "||") {
+		// true || x, false && x
+		if l.value {
+			return a, nil
+		}
+		return l.op == "||", nil
+	}
+	b, err := l.b.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if l.value {
+		return b, nil
+	}
+	return typutil.AsBool(b), nil
+}
+
+func (l *varLogic) IsStatic() bool {
+	return l.a.IsStatic() && l.b.IsStatic()
+}
+
+// varConditional evaluates one of two branches depending on a condition.
+// Implements the ternary operator: cond ? yes : no
+type varConditional struct {
+	cond, yes, no Var
+}
+
+func (c *varConditional) Resolve(ctx context.Context) (any, error) {
+	cond, err := c.cond.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if typutil.AsBool(cond) {
+		return c.yes.Resolve(ctx)
+	}
+	return c.no.Resolve(ctx)
+}
+
+func (c *varConditional) IsStatic() bool {
+	return c.cond.IsStatic() && c.yes.IsStatic() && c.no.IsStatic()
+}
+
+// varIf resolves the body of the first branch whose condition is true, or
+// the else body if none is. Without an else body, it resolves to an empty
+// string. Implements {{if cond}}...{{else if cond}}...{{else}}...{{end}}.
+type varIf struct {
+	conds  []Var // one condition per branch
+	bodies []Var // one body per branch, followed by the optional else body
+}
+
+func (b *varIf) Resolve(ctx context.Context) (any, error) {
+	for i, cond := range b.conds {
+		v, err := cond.Resolve(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if typutil.AsBool(v) {
+			return b.bodies[i].Resolve(ctx)
+		}
+	}
+	if len(b.bodies) > len(b.conds) {
+		return b.bodies[len(b.conds)].Resolve(ctx)
+	}
+	return "", nil
+}
+
+func (b *varIf) IsStatic() bool {
+	for _, cond := range b.conds {
+		if !cond.IsStatic() {
+			return false
+		}
+	}
+	for _, body := range b.bodies {
+		if !body.IsStatic() {
+			return false
+		}
+	}
+	return true
+}
+
+// loopKey is the context key under which varFor also stores its loop
+// metadata, so that loop.parent is only ever set from an enclosing loop and
+// never from a caller's context value named "loop".
+type loopKey struct{}
+
+// varFor resolves its body once for each element of a slice, array or map,
+// and concatenates the results. Each iteration resolves the body with a
+// derived context in which the loop variables and the loop metadata are
+// bound, so nested loops shadow outer ones and the caller's context is left
+// untouched. Map keys are iterated in sorted order.
+// Implements {{for value in expr}}...{{else}}...{{end}}.
+type varFor struct {
+	key, value string // names bound to each key (optional) and value
+	sub        Var    // collection to iterate over
+	body       Var    // resolved for each element
+	empty      Var    // resolved if the collection is empty, may be nil
+}
+
+func (f *varFor) Resolve(ctx context.Context) (any, error) {
+	sub, err := f.sub.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, values, err := loopItems(sub)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		if f.empty != nil {
+			return f.empty.Resolve(ctx)
+		}
+		return "", nil
+	}
+	if f.key == "" && reflect.ValueOf(sub).Kind() == reflect.Map {
+		// a single variable iterates over the keys of a map
+		values = keys
+	}
+
+	parent := ctx.Value(loopKey{})
+	res := &bytes.Buffer{}
+	for i, v := range values {
+		loop := map[string]any{
+			"index":  i + 1,
+			"index0": i,
+			"first":  i == 0,
+			"last":   i == len(values)-1,
+			"length": len(values),
+			"parent": parent,
+		}
+		c := context.WithValue(ctx, loopKey{}, loop)
+		c = context.WithValue(c, "loop", loop)
+		if f.key != "" {
+			c = context.WithValue(c, f.key, keys[i])
+		}
+		c = context.WithValue(c, f.value, v)
+		out, err := f.body.Resolve(c)
+		if err != nil {
+			return nil, err
+		}
+		res.WriteString(asString(out))
+	}
+	return res.String(), nil
+}
+
+func (f *varFor) IsStatic() bool {
+	return f.sub.IsStatic() && f.body.IsStatic() && (f.empty == nil || f.empty.IsStatic())
+}
+
+// loopItems returns the keys and values a for block iterates over: indexes
+// and elements for slices and arrays, or keys and values for maps, sorted by
+// key. A nil collection has no items.
+func loopItems(sub any) ([]any, []any, error) {
+	if sub == nil {
+		return nil, nil, nil
+	}
+	v := reflect.ValueOf(sub)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		keys := make([]any, v.Len())
+		values := make([]any, v.Len())
+		for i := range values {
+			keys[i] = i
+			values[i] = v.Index(i).Interface()
+		}
+		return keys, values, nil
+	case reflect.Map:
+		mk := v.MapKeys()
+		sort.Slice(mk, func(i, j int) bool { return compareKeys(mk[i], mk[j]) < 0 })
+		keys := make([]any, len(mk))
+		values := make([]any, len(mk))
+		for i, k := range mk {
+			keys[i] = k.Interface()
+			values[i] = v.MapIndex(k).Interface()
+		}
+		return keys, values, nil
+	}
+	return nil, nil, fmt.Errorf("for requires a slice or map, got %T", sub)
+}
+
+// varSet resolves its body with a derived context in which name is bound to
+// the value of an expression, evaluated once. The binding shadows any context
+// value of the same name without modifying the caller's context.
+// Implements {{set name = expr}}, which applies to the rest of the enclosing
+// block or template.
+type varSet struct {
+	name  string
+	value Var
+	body  Var
+}
+
+func (s *varSet) Resolve(ctx context.Context) (any, error) {
+	v, err := s.value.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.body.Resolve(context.WithValue(ctx, s.name, v))
+}
+
+func (s *varSet) IsStatic() bool {
+	return s.value.IsStatic() && s.body.IsStatic()
+}
+
+// compareKeys orders map keys for iteration. Strings, numbers and bools are
+// compared by value, keys of different types by type name, and other keys by
+// their string representation, so the order is always deterministic.
+func compareKeys(a, b reflect.Value) int {
+	if a.Kind() == reflect.Interface {
+		a = a.Elem()
+	}
+	if b.Kind() == reflect.Interface {
+		b = b.Elem()
+	}
+	if !a.IsValid() || !b.IsValid() {
+		// nil interface keys come first
+		return compareInt64(boolInt(a.IsValid()), boolInt(b.IsValid()))
+	}
+	if a.Type() != b.Type() {
+		return strings.Compare(a.Type().String(), b.Type().String())
+	}
+	switch a.Kind() {
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareInt64(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return compareUint64(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return compareFloat64(a.Float(), b.Float())
+	case reflect.Bool:
+		return compareInt64(boolInt(a.Bool()), boolInt(b.Bool()))
+	}
+	return strings.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+}
+
+// boolInt returns 1 for true and 0 for false.
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// varCoalesce returns its first operand unless it is nil, including typed nil
+// maps, slices and pointers, in which case the second operand is evaluated
+// and returned.
+// Implements the ?? operator.
+type varCoalesce struct {
+	a, b Var
+}
+
+func (c *varCoalesce) Resolve(ctx context.Context) (any, error) {
+	a, err := c.a.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !isNil(a) {
+		return a, nil
+	}
+	return c.b.Resolve(ctx)
+}
+
+func (c *varCoalesce) IsStatic() bool {
+	return c.a.IsStatic() && c.b.IsStatic()
+}
+
+// asString converts v to its string representation in text output, where
+// nil renders as an empty string.
+func asString(v any) string {
+	if v == nil {
+		return ""
+	}
+	s, _ := typutil.AsString(v)
+	return s
+}
+
+// isNil returns true if v is nil or a nil pointer, map, slice, interface,
+// channel or function.
+func isNil(v any) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface, reflect.Chan, reflect.Func:
+		return rv.IsNil()
+	}
+	return false
+}
+
 // varFilter applies a registered filter function to its input value.
 // Implements the pipe syntax: {{value|filtername}}
 type varFilter struct {
@@ -347,6 +1023,197 @@ func (f *varFilter) IsStatic() bool {
 	return true
 }
 
+// varIn checks whether a value is contained in another: a substring of a
+// string, an element of a slice or array, or a key of a map.
+// Implements the in and not in operators.
+type varIn struct {
+	needle, haystack Var
+	not              bool // not in
+}
+
+func (v *varIn) Resolve(ctx context.Context) (any, error) {
+	needle, err := v.needle.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	haystack, err := v.haystack.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := contains(haystack, needle)
+	if err != nil {
+		return nil, err
+	}
+	return res != v.not, nil
+}
+
+func (v *varIn) IsStatic() bool {
+	return v.needle.IsStatic() && v.haystack.IsStatic()
+}
+
+// contains returns true if needle is a substring of haystack (string), an
+// element of haystack (slice or array), or a key of haystack (map). A nil
+// haystack contains nothing.
+func contains(haystack, needle any) (bool, error) {
+	switch h := haystack.(type) {
+	case nil:
+		return false, nil
+	case string:
+		s, ok := keyString(needle)
+		return ok && strings.Contains(h, s), nil
+	case []any:
+		for _, e := range h {
+			if equalValues(e, needle) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]any:
+		k, ok := keyString(needle)
+		if !ok {
+			return false, nil
+		}
+		_, ok = h[k]
+		return ok, nil
+	case map[string]string:
+		k, ok := keyString(needle)
+		if !ok {
+			return false, nil
+		}
+		_, ok = h[k]
+		return ok, nil
+	}
+
+	v := reflect.ValueOf(haystack)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if equalValues(v.Index(i).Interface(), needle) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case reflect.Map:
+		k, err := mapKey(needle, v.Type().Key())
+		if err != nil {
+			// needle cannot be a key of this map
+			return false, nil
+		}
+		return v.MapIndex(k).IsValid(), nil
+	}
+	return false, fmt.Errorf("in requires a string, slice or map, got %T", haystack)
+}
+
+// varMatch checks whether a value matches a regular expression.
+// Implements the =~ and !~ operators.
+type varMatch struct {
+	sub, pattern Var
+	re           *regexp.Regexp // compiled pattern, if static
+	not          bool           // !~
+}
+
+func (m *varMatch) Resolve(ctx context.Context) (any, error) {
+	sub, err := m.sub.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	re := m.re
+	if re == nil {
+		pattern, err := m.pattern.Resolve(ctx)
+		if err != nil {
+			return nil, err
+		}
+		str, err := regexpPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		re, err = compileRegexp(str)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return re.MatchString(asString(sub)) != m.not, nil
+}
+
+func (m *varMatch) IsStatic() bool {
+	return m.sub.IsStatic() && m.pattern.IsStatic()
+}
+
+// regexpCacheSize is the maximum number of dynamic patterns kept compiled.
+const regexpCacheSize = 256
+
+var (
+	regexpCache   = map[string]*regexp.Regexp{}
+	regexpCacheLk sync.RWMutex
+)
+
+// regexpPattern converts the resolved pattern of =~ or !~ to a string. A
+// null pattern is an error rather than matching the text "<nil>".
+func regexpPattern(pattern any) (string, error) {
+	if pattern == nil {
+		return "", errors.New("regular expression pattern is null")
+	}
+	str, _ := typutil.AsString(pattern)
+	return str, nil
+}
+
+// compileRegexp compiles a regular expression, using a cache for patterns
+// that are only known when resolving.
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCacheLk.RLock()
+	re, ok := regexpCache[pattern]
+	regexpCacheLk.RUnlock()
+	if ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression: %w", err)
+	}
+
+	regexpCacheLk.Lock()
+	defer regexpCacheLk.Unlock()
+	if len(regexpCache) >= regexpCacheSize {
+		// drop everything rather than tracking usage
+		regexpCache = map[string]*regexp.Regexp{}
+	}
+	regexpCache[pattern] = re
+	return re, nil
+}
+
+// varCall calls a registered function with the resolved arguments.
+// Implements the call syntax: {{name(arg1, arg2)}}
+type varCall struct {
+	name string
+	fn   *function
+	args []Var
+}
+
+func (c *varCall) Resolve(ctx context.Context) (any, error) {
+	args := make([]any, 0, len(c.args))
+	for _, a := range c.args {
+		v, err := a.Resolve(ctx)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	return c.fn.fn(ctx, args)
+}
+
+func (c *varCall) IsStatic() bool {
+	if !c.fn.pure {
+		return false
+	}
+	for _, a := range c.args {
+		if !a.IsStatic() {
+			return false
+		}
+	}
+	return true
+}
+
 // varJsonMarshal wraps a variable and JSON-encodes its resolved value.
 // Used when parsing in "json" mode to ensure embedded values are valid JSON.
 type varJsonMarshal struct {